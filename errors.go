@@ -0,0 +1,51 @@
+package tsf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reasons why a SoundFont could not be loaded
+var (
+	ErrNotRIFF      = errors.New("tsf: not a RIFF SoundFont (missing sfbk header)")
+	ErrIncomplete   = errors.New("tsf: SoundFont is missing preset, instrument or sample headers")
+	ErrNoSampleData = errors.New("tsf: SoundFont has no sample data")
+)
+
+// Reasons why a MIDI file could not be loaded (or was only partially loaded)
+var (
+	ErrNotMidi        = errors.New("tml: not a MIDI file")
+	ErrTruncated      = errors.New("tml: unexpected end of file")
+	ErrInvalidTrack   = errors.New("tml: invalid MTrk header")
+	ErrTrackLength    = errors.New("tml: track length did not match data length")
+	ErrRunningStatus  = errors.New("tml: undefined status and invalid running status")
+	ErrVariableLength = errors.New("tml: invalid variable length quantity")
+	ErrInvalidMeta    = errors.New("tml: invalid meta event length")
+	ErrOutOfMemory    = errors.New("tml: out of memory")
+	ErrNoMessages     = errors.New("tml: file contains no messages")
+
+	// Deprecated: SMPTE timing is supported now, this error is not returned anymore.
+	ErrSMPTETiming = errors.New("tml: file uses unsupported SMPTE timing")
+)
+
+// A LoadError describes why a SoundFont or MIDI file was rejected.
+// Use errors.Is to compare it against the Err* values.
+type LoadError struct {
+	Err    error
+	Track  int // MIDI track the problem was found in, or -1
+	Offset int // byte offset in the file where the problem was detected, or -1
+}
+
+func (e *LoadError) Error() string {
+	switch {
+	case e.Track >= 0:
+		return fmt.Sprintf("%v (track %d, offset %d)", e.Err, e.Track, e.Offset)
+	case e.Offset >= 0:
+		return fmt.Sprintf("%v (offset %d)", e.Err, e.Offset)
+	}
+	return e.Err.Error()
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
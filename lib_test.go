@@ -1,9 +1,19 @@
 package tsf
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sync"
 	"testing"
 )
 
@@ -25,10 +35,6 @@ func TestRawOutput(t *testing.T) {
 
 	font.SetOutput(OutputModeStereoInterleaved, sampleRate, 0)
 
-	// ensure channel 9 is using drum kit 0 (some midis don't set it for some reason)
-	font.ChannelSetBank(9, 128)
-	font.ChannelSetPresetNumber(9, 0, false)
-
 	buffer := make([]int16, 2048)
 	msec := 0.0
 
@@ -81,8 +87,12 @@ func TestRawOutput(t *testing.T) {
 
 				switch msg.Type() {
 				case ProgramChange:
-					font.ChannelSetPresetNumber(msg.Channel(), msg.Program(), msg.Channel() == 9)
-					output = fmt.Sprintf("Program=%d Drums=%v", msg.Program(), msg.Channel() == 9)
+					font.ChannelMidiProgram(msg.Channel(), msg.Program())
+					output = fmt.Sprintf("Program=%d Drums=%v", msg.Program(), font.ChannelGetDrums(msg.Channel()))
+					break
+				case SysEx:
+					applied := font.MidiSysEx(msg.Data())
+					output = fmt.Sprintf("% X Applied=%v", msg.Data(), applied)
 					break
 				case NoteOn:
 					font.ChannelNoteOn(msg.Channel(), msg.Key(), float32(msg.Velocity())/127.0)
@@ -96,6 +106,14 @@ func TestRawOutput(t *testing.T) {
 					font.ChannelSetPitchWheel(msg.Channel(), msg.PitchBend())
 					output = fmt.Sprintf("Value=%d", msg.PitchBend())
 					break
+				case ChannelPressure:
+					font.ChannelPressure(msg.Channel(), msg.ChannelPressure())
+					output = fmt.Sprintf("Pressure=%d", msg.ChannelPressure())
+					break
+				case KeyPressure:
+					font.ChannelKeyPressure(msg.Channel(), msg.Key(), msg.KeyPressure())
+					output = fmt.Sprintf("Key=%d Pressure=%d", msg.Key(), msg.KeyPressure())
+					break
 				case ControlChange:
 					font.ChannelMidiControl(msg.Channel(), msg.Control(), msg.ControlValue())
 
@@ -125,3 +143,835 @@ func TestRawOutput(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadErrors(t *testing.T) {
+	if _, err := ReadSoundFontMemory([]byte("RIFF\x04\x00\x00\x00WAVE")); !errors.Is(err, ErrNotRIFF) {
+		t.Errorf("expected ErrNotRIFF, got %v", err)
+	}
+
+	font, err := ReadSoundFontFile("winxp.sf2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font.Close()
+
+	if _, err := ReadSoundFontFile("missing.sf2"); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+
+	// 32 frames per second
+	smpte := []byte("MThd\x00\x00\x00\x06\x00\x00\x00\x01\xe0\x28")
+
+	if _, err := ReadMidiMemory(smpte); !errors.Is(err, ErrNotMidi) {
+		t.Errorf("expected ErrNotMidi, got %v", err)
+	}
+
+	mid, err := ioutil.ReadFile("expanse.mid")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	song, err := ReadMidiMemory(mid)
+
+	if err != nil || len(song.Events) == 0 {
+		t.Fatalf("expected events, got %v", err)
+	}
+
+	// cut off inside the second track
+	song, err = ReadMidiMemory(mid[:200])
+
+	var loadErr *LoadError
+
+	if !errors.As(err, &loadErr) || !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected ErrTruncated, got %v", err)
+	}
+
+	if loadErr.Track != 1 || loadErr.Offset != 103 {
+		t.Errorf("expected track 1 at offset 103, got track %d at offset %d", loadErr.Track, loadErr.Offset)
+	}
+
+	if song == nil || len(song.Events) == 0 {
+		t.Error("expected the events of the first track")
+	}
+}
+
+type failingReader struct {
+	r   io.Reader
+	n   int
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, f.err
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestLoadStream(t *testing.T) {
+	file, err := os.Open("winxp.sf2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	// hide the io.Seeker so chunks get skipped by reading
+	font, err := LoadSoundFont(bufio.NewReader(file))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer font.Close()
+
+	if font.GetPresetCount() == 0 {
+		t.Error("expected presets")
+	}
+
+	mid, err := ioutil.ReadFile("expanse.mid")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	midi, err := OpenMidi(bytes.NewReader(mid))
+
+	if err != nil || midi.Messages().IsNil() {
+		t.Errorf("expected messages, got %v", err)
+	}
+
+	midi.Close()
+
+	broken := errors.New("connection reset")
+
+	if _, err := LoadMidi(&failingReader{bytes.NewReader(mid), 1000, broken}); err != broken {
+		t.Errorf("expected reader error, got %v", err)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadSoundFont(&failingReader{file, 100000, broken}); err != broken {
+		t.Errorf("expected reader error, got %v", err)
+	}
+}
+
+func residentMemory(t *testing.T) int {
+	runtime.GC()
+	runtime.GC() // finalizers queued by the first collection have run by now
+	debug.FreeOSMemory()
+
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+
+	if err != nil {
+		t.Skip("resident memory not available:", err)
+	}
+
+	var size, resident int
+
+	if _, err := fmt.Sscan(string(statm), &size, &resident); err != nil {
+		t.Skip("resident memory not available:", err)
+	}
+
+	return resident * os.Getpagesize()
+}
+
+func TestNoLeaks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow")
+	}
+
+	sf2, err := ioutil.ReadFile("winxp.sf2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mid, err := ioutil.ReadFile("expanse.mid")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(i int) {
+		font := LoadSoundFontMemory(sf2)
+		msg := LoadMidiMemory(mid)
+
+		if font.IsNil() || msg.IsNil() {
+			t.Fatal("load failed")
+		}
+
+		// the samples are shared with the copy and freed with the last instance
+		shared := font.Copy()
+
+		// every other font is left to the finalizer
+		if i%2 == 0 {
+			font.Close()
+		}
+
+		if i%3 == 0 {
+			shared.Close()
+		}
+
+		for j := 0; j < 20; j++ {
+			file, err := OpenMidi(bytes.NewReader(mid))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			file.Close()
+
+			if _, err := ReadMidiMemory(mid); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if i%10 == 0 {
+			runtime.GC()
+		}
+	}
+
+	// let the C allocator settle on its working set first
+	for i := 0; i < 20; i++ {
+		load(i)
+	}
+
+	before := residentMemory(t)
+
+	// each leaked font would cost 6MB of samples
+	for i := 0; i < 200; i++ {
+		load(i)
+	}
+
+	after := residentMemory(t)
+
+	if after-before > 32<<20 {
+		t.Errorf("resident memory grew from %dKB to %dKB", before>>10, after>>10)
+	}
+}
+
+func TestSysEx(t *testing.T) {
+	font, err := ReadSoundFontFile("winxp.sf2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer font.Close()
+
+	font.SetOutput(OutputModeStereoInterleaved, 44100, 0)
+
+	mid := smf(0, 96,
+		"\x00\xf0\x05\x7e\x7f\x09\x01\xf7"+
+			"\x00\xff\x2f\x00")
+
+	song, err := ReadMidiMemory(mid)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := song.Events[0]; e.Type != SysEx || !bytes.Equal(e.Payload, []byte("\x7e\x7f\x09\x01\xf7")) || !font.MidiSysEx(e.Payload) {
+		t.Errorf("expected GM System On, got %+v", e)
+	}
+
+	kit := font.GetPresetIndex(128, 0)
+
+	// channel 9 gets the standard kit like General MIDI requires
+	if !font.ChannelGetDrums(9) || font.ChannelGetPresetIndex(9) != kit || font.ChannelGetDrums(0) {
+		t.Errorf("expected drums on channel 9 only, got preset %d", font.ChannelGetPresetIndex(9))
+	}
+
+	// GS: use part 11 (channel 10) for rhythm
+	if !font.MidiSysEx([]byte("\xf0\x41\x10\x42\x12\x40\x1a\x15\x02\x0f\xf7")) || !font.ChannelGetDrums(10) {
+		t.Error("expected drums on channel 10")
+	}
+
+	if font.ChannelMidiProgram(10, 0) == 0 || font.ChannelGetPresetIndex(10) != kit {
+		t.Errorf("expected the standard kit on channel 10, got preset %d", font.ChannelGetPresetIndex(10))
+	}
+
+	font.ChannelMidiProgram(3, 40)
+	font.ChannelMidiControl(3, VolumeMSB, 20)
+
+	// master volume at half
+	if !font.MidiSysEx([]byte("\x7f\x7f\x04\x01\x00\x40\xf7")) {
+		t.Error("expected master volume to be applied")
+	}
+
+	if !font.MidiSysEx([]byte("\x43\x10\x4c\x00\x00\x7e\x00\xf7")) {
+		t.Error("expected XG System On to be applied")
+	}
+
+	if font.ChannelGetDrums(10) || font.ChannelGetPresetNumber(3) != 0 || font.ChannelGetVolume(3) != 1 {
+		t.Error("expected XG System On to reset all channels")
+	}
+
+	if font.MidiSysEx([]byte("\x43\x10\x4c\x02\x01\x00\x01\xf7")) {
+		t.Error("expected XG effect parameters to be ignored")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	font, err := ReadSoundFontFile("winxp.sf2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font.SetOutput(OutputModeMono, 22050, 0)
+	font.ChannelMidiProgram(0, 40)
+	font.ChannelNoteOn(0, 60, 1)
+
+	copies := []SoundFont{font.Copy(), font.Copy()}
+
+	// the copies start without voices and channels but with the output settings
+	for _, c := range copies {
+		if c.ActiveVoiceCount() != 0 || c.ChannelGetPresetNumber(0) != 0 || c.GetSampleRate() != 22050 {
+			t.Error("expected a copy without voices and channels")
+		}
+	}
+
+	// the copies work on their own once the original is closed
+	font.Close()
+
+	results := make([][]float32, len(copies))
+	var wg sync.WaitGroup
+
+	for i, c := range copies {
+		wg.Add(1)
+		go func(i int, c SoundFont) {
+			defer wg.Done()
+			c.ChannelMidiProgram(0, 0)
+			c.ChannelNoteOn(0, 60, 1)
+			results[i] = make([]float32, 22050)
+			c.RenderFloat(results[i], 22050, false)
+			c.Close()
+		}(i, c)
+	}
+
+	wg.Wait()
+
+	if firstSound(results[0], 1) < 0 || !reflect.DeepEqual(results[0], results[1]) {
+		t.Error("expected the copies to render the same note")
+	}
+}
+
+func TestPedals(t *testing.T) {
+	font, err := ReadSoundFontFile("winxp.sf2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer font.Close()
+
+	font.SetOutput(OutputModeMono, 44100, 0)
+	buffer := make([]float32, 44100)
+
+	// a violin keeps playing until its note off
+	font.ChannelMidiProgram(0, 40)
+	font.ChannelNoteOn(0, 60, 1)
+	voices := font.ActiveVoiceCount()
+
+	// the sustain pedal holds the note after its note off
+	font.ChannelMidiControl(0, SustainSwitch, 127)
+	font.ChannelNoteOff(0, 60)
+	font.RenderFloat(buffer, 44100, false)
+
+	if font.ActiveVoiceCount() != voices {
+		t.Fatalf("expected the sustain pedal to hold %d voices, got %d", voices, font.ActiveVoiceCount())
+	}
+
+	font.ChannelMidiControl(0, SustainSwitch, 0)
+	font.RenderFloat(buffer, 44100, false)
+
+	if font.ActiveVoiceCount() != 0 {
+		t.Fatalf("expected the note to end with the sustain pedal, got %d voices", font.ActiveVoiceCount())
+	}
+
+	// the sostenuto pedal only holds the notes held down while pressing it
+	font.ChannelNoteOn(0, 60, 1)
+	font.ChannelMidiControl(0, SostenutoSwitch, 127)
+	font.ChannelNoteOn(0, 64, 1)
+	font.ChannelNoteOff(0, 60)
+	font.ChannelNoteOff(0, 64)
+	font.RenderFloat(buffer, 44100, false)
+
+	if font.ActiveVoiceCount() != voices {
+		t.Fatalf("expected the sostenuto pedal to hold only the first note, got %d voices", font.ActiveVoiceCount())
+	}
+
+	// another note off of the same key doesn't end it either
+	font.ChannelNoteOff(0, 60)
+	font.RenderFloat(buffer, 44100, false)
+
+	if font.ActiveVoiceCount() != voices {
+		t.Fatalf("expected the sostenuto pedal to hold the note, got %d voices", font.ActiveVoiceCount())
+	}
+
+	font.ChannelMidiControl(0, SostenutoSwitch, 0)
+	font.RenderFloat(buffer, 44100, false)
+
+	if font.ActiveVoiceCount() != 0 {
+		t.Fatalf("expected the note to end with the sostenuto pedal, got %d voices", font.ActiveVoiceCount())
+	}
+
+	// the soft pedal makes notes quieter
+	peak := func() float32 {
+		font.ChannelNoteOn(0, 60, 1)
+		font.RenderFloat(buffer, 44100, false)
+		max := float32(0)
+		for _, s := range buffer {
+			if s > max {
+				max = s
+			}
+		}
+		font.ChannelSoundsOffAll(0)
+		font.RenderFloat(buffer, 44100, false)
+		return max
+	}
+
+	loud := peak()
+	font.ChannelMidiControl(0, SoftPedalSwitch, 127)
+
+	if soft := peak(); soft >= loud*0.75 {
+		t.Errorf("expected the soft pedal to make the note quieter, got a peak of %v instead of %v", soft, loud)
+	}
+}
+
+func TestEffects(t *testing.T) {
+	font, err := ReadSoundFontFile("winxp.sf2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer font.Close()
+
+	font.SetOutput(OutputModeStereoInterleaved, 44100, 0)
+	buffer := make([]float32, 2*4410)
+
+	// renders a short piano note, returns the output after its voices ended
+	play := func(reverb, chorus int) []float32 {
+		font.Reset()
+		font.ChannelMidiProgram(0, 0)
+		font.ChannelMidiControl(0, EffectsDepth1, reverb)
+		font.ChannelMidiControl(0, EffectsDepth3, chorus)
+		font.ChannelNoteOn(0, 60, 1)
+		font.RenderFloat(buffer, 4410, false)
+		font.ChannelNoteOff(0, 60)
+		for i := 0; font.ActiveVoiceCount() > 0; i++ {
+			if i == 100 {
+				t.Fatal("expected the note to end")
+			}
+			font.RenderFloat(buffer, 4410, false)
+		}
+		font.RenderFloat(buffer, 4410, false)
+		return append([]float32(nil), buffer...)
+	}
+
+	silent := func(samples []float32) bool {
+		for _, s := range samples {
+			if s != 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	if silent(play(127, 0)) {
+		t.Error("expected the reverb to ring on after the note")
+	}
+
+	// the reverb tail ends
+	for i := 0; !silent(buffer); i++ {
+		if i == 100 {
+			t.Fatal("expected the reverb to end")
+		}
+		font.RenderFloat(buffer, 4410, false)
+	}
+
+	if !silent(play(0, 0)) {
+		t.Error("expected no effects without sends")
+	}
+
+	if silent(play(0, 127)) {
+		t.Error("expected the chorus to ring on after the note")
+	}
+
+	font.SetEffects(false, false)
+
+	if !silent(play(127, 127)) {
+		t.Error("expected no effects when they are disabled")
+	}
+
+	// a larger room rings on longer
+	font.SetEffects(true, false)
+	font.SetReverb(0.9, 0, 1, 1)
+	play(127, 0)
+
+	for i := 0; i < 20; i++ {
+		font.RenderFloat(buffer, 4410, false)
+	}
+
+	if silent(buffer) {
+		t.Error("expected a large room to ring on for more than 2 seconds")
+	}
+
+	// a copy starts out with the same effects
+	font = font.Copy()
+	defer font.Close()
+	play(127, 0)
+
+	for i := 0; i < 20; i++ {
+		font.RenderFloat(buffer, 4410, false)
+	}
+
+	if silent(buffer) {
+		t.Error("expected the copy to keep the large room")
+	}
+}
+
+// A modulator record of a SoundFont
+type sfModulator struct {
+	Src, Dest uint16
+	Amount    int16
+	AmountSrc uint16
+	Transform uint16
+}
+
+// Returns a SoundFont with a single preset playing a looped sine wave, the original pitch is key 69
+// The modulators are put into the preset zone and the instrument zone, the effects are disabled.
+func sineFont(t *testing.T, presetMods, instMods []sfModulator) SoundFont {
+	type phdr struct {
+		Name                       [20]byte
+		Preset, Bank, Bag          uint16
+		Library, Genre, Morphology uint32
+	}
+	type inst struct {
+		Name [20]byte
+		Bag  uint16
+	}
+	type bag struct{ Gen, Mod uint16 }
+	type gen struct {
+		Oper   uint16
+		Amount int16
+	}
+	type shdr struct {
+		Name                                       [20]byte
+		Start, End, StartLoop, EndLoop, SampleRate uint32
+		OriginalPitch                              uint8
+		PitchCorrection                            int8
+		SampleLink, SampleType                     uint16
+	}
+
+	records := func(values ...interface{}) []byte {
+		var b bytes.Buffer
+		for _, v := range values {
+			binary.Write(&b, binary.LittleEndian, v)
+		}
+		return b.Bytes()
+	}
+	chunk := func(id string, data ...[]byte) []byte {
+		body := bytes.Join(data, nil)
+		return append(append([]byte(id), records(uint32(len(body)))...), body...)
+	}
+	name := func(s string) (n [20]byte) {
+		copy(n[:], s)
+		return n
+	}
+
+	// ten periods of 100 samples
+	samples := make([]int16, 1000)
+	for i := range samples {
+		samples[i] = int16(16384 * math.Sin(2*math.Pi*float64(i)/100))
+	}
+
+	data := chunk("RIFF", []byte("sfbk"),
+		chunk("LIST", []byte("sdta"), chunk("smpl", records(samples))),
+		chunk("LIST", []byte("pdta"),
+			chunk("phdr", records(phdr{Name: name("Sine")}, phdr{Name: name("EOP"), Bag: 1})),
+			chunk("pbag", records(bag{0, 0}, bag{1, uint16(len(presetMods))})),
+			chunk("pmod", records(presetMods, sfModulator{})),
+			chunk("pgen", records(gen{41, 0}, gen{})),
+			chunk("inst", records(inst{name("Sine"), 0}, inst{name("EOI"), 1})),
+			chunk("ibag", records(bag{0, 0}, bag{2, uint16(len(instMods))})),
+			chunk("imod", records(instMods, sfModulator{})),
+			chunk("igen", records(gen{54, 1}, gen{53, 0}, gen{})),
+			chunk("shdr", records(shdr{Name: name("Sine"), End: 1000, EndLoop: 1000, SampleRate: 44100, OriginalPitch: 69, SampleType: 1}, shdr{Name: name("EOS")}))))
+
+	font, err := ReadSoundFontMemory(data)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font.SetOutput(OutputModeMono, 44100, 0)
+	font.SetEffects(false, false)
+	font.ChannelMidiProgram(0, 0)
+
+	return font
+}
+
+// Renders 0.1s of a mono SoundFont, returns the peak level and the number of
+// zero crossings of the second half, after the voices have settled
+func renderSine(font SoundFont) (peak float64, crossings int) {
+	buffer := make([]float32, 4410)
+	font.RenderFloat(buffer, 4410, false)
+	for i, s := range buffer[2205:] {
+		peak = math.Max(peak, math.Abs(float64(s)))
+		if i > 0 && (s < 0) != (buffer[2205+i-1] < 0) {
+			crossings++
+		}
+	}
+	return peak, crossings
+}
+
+// Returns true if a peak level is within 2% of the expected one
+func nearLevel(value, expected float64) bool {
+	return math.Abs(value-expected) < expected*0.02
+}
+
+func TestModulators(t *testing.T) {
+	// plays a note with the modulation wheel at the given position, returns the peak level
+	play := func(font SoundFont, vel float32, modulation int) float64 {
+		font.ChannelMidiControl(0, ModulationMSB, modulation)
+		font.ChannelNoteOn(0, 69, vel)
+		level, _ := renderSine(font)
+		font.ChannelSoundsOffAll(0)
+		renderSine(font)
+		return level
+	}
+
+	// the default modulators attenuate by the velocity
+	font := sineFont(t, nil, nil)
+	full := play(font, 1, 0)
+
+	if !nearLevel(full, 0.5) {
+		t.Errorf("expected a peak of 0.5, got %v", full)
+	}
+
+	if level, expected := play(font, 0.5, 0), math.Pow(63.0/127, 2)*full; !nearLevel(level, expected) {
+		t.Errorf("expected a peak of %v at half velocity, got %v", expected, level)
+	}
+
+	// the vibrato of the modulation wheel doesn't change the level
+	if level := play(font, 1, 127); !nearLevel(level, full) {
+		t.Errorf("expected the modulation wheel to keep a peak of %v, got %v", full, level)
+	}
+
+	font.Close()
+
+	// an instrument modulator attenuating by the modulation wheel, 20dB
+	wheel := sfModulator{Src: 0x0081, Dest: 48, Amount: 200}
+	font = sineFont(t, nil, []sfModulator{wheel})
+
+	if level := play(font, 1, 127); !nearLevel(level, full*0.1) {
+		t.Errorf("expected the modulation wheel to attenuate by 20dB, got a peak of %v", level)
+	}
+
+	// playing notes follow the controller
+	font.ChannelMidiControl(0, ModulationMSB, 0)
+	font.ChannelNoteOn(0, 69, 1)
+	renderSine(font)
+	font.ChannelMidiControl(0, ModulationMSB, 127)
+
+	if level, _ := renderSine(font); !nearLevel(level, full*0.1) {
+		t.Errorf("expected the playing note to be attenuated by 20dB, got a peak of %v", level)
+	}
+
+	font.Close()
+
+	// the same modulator in the preset adds to the instrument
+	font = sineFont(t, []sfModulator{wheel}, []sfModulator{wheel})
+
+	if level := play(font, 1, 127); !nearLevel(level, full*0.01) {
+		t.Errorf("expected the modulation wheel to attenuate by 40dB, got a peak of %v", level)
+	}
+
+	font.Close()
+
+	// an instrument modulator replaces the default velocity attenuation, a preset modulator adds to it
+	velocity := sfModulator{Src: 0x0502, Dest: 48}
+
+	for _, test := range []struct {
+		presetMods, instMods []sfModulator
+		expected             float64
+	}{
+		{nil, []sfModulator{velocity}, full},
+		{[]sfModulator{{Src: 0x0502, Dest: 48, Amount: -480}}, nil, 63.0 / 127 * full},
+	} {
+		font = sineFont(t, test.presetMods, test.instMods)
+
+		if level := play(font, 0.5, 0); !nearLevel(level, test.expected) {
+			t.Errorf("modulators %v %v: expected a peak of %v at half velocity, got %v", test.presetMods, test.instMods, test.expected, level)
+		}
+
+		font.Close()
+	}
+}
+
+func TestPressure(t *testing.T) {
+	font := sineFont(t, nil, nil)
+	defer font.Close()
+
+	// renders the playing note, returns its peak level
+	level := func() float64 {
+		peak, _ := renderSine(font)
+		return peak
+	}
+
+	font.ChannelNoteOn(0, 69, 1)
+	full := level()
+
+	// without a pressure response only the modulators of the SoundFont follow pressure and breath
+	font.ChannelPressure(0, 127)
+	font.ChannelMidiControl(0, BreathMSB, 127)
+
+	if peak := level(); !nearLevel(peak, full) || font.ChannelGetPressure(0) != 127 {
+		t.Errorf("expected pressure and breath to keep the peak at %v by default, got %v", full, peak)
+	}
+
+	font.ChannelPressure(0, 0)
+	font.ChannelMidiControl(0, BreathMSB, 0)
+
+	// notes without pressure are 6dB softer
+	font.ChannelSetPressureResponse(0, 50, 2400, 6)
+	soft := full * math.Pow(10, -6.0/20)
+
+	if peak := level(); !nearLevel(peak, soft) {
+		t.Errorf("expected the pressure response to lower the peak to %v, got %v", soft, peak)
+	}
+
+	// full pressure plays them at their normal volume
+	font.ChannelPressure(0, 127)
+
+	if peak := level(); !nearLevel(peak, full) {
+		t.Errorf("expected channel pressure to raise the peak to %v, got %v", full, peak)
+	}
+
+	font.ChannelPressure(0, 0)
+
+	// key pressure only affects the notes of its key
+	font.ChannelKeyPressure(0, 70, 127)
+
+	if peak := level(); !nearLevel(peak, soft) {
+		t.Errorf("expected the pressure of another key to keep the peak at %v, got %v", soft, peak)
+	}
+
+	font.ChannelKeyPressure(0, 69, 127)
+
+	if peak := level(); !nearLevel(peak, full) || font.ChannelGetKeyPressure(0, 69) != 127 {
+		t.Errorf("expected key pressure to raise the peak to %v, got %v", full, peak)
+	}
+
+	// as does the breath controller
+	font.ChannelKeyPressure(0, 69, 0)
+	font.ChannelMidiControl(0, BreathMSB, 127)
+
+	if peak := level(); !nearLevel(peak, full) {
+		t.Errorf("expected the breath controller to raise the peak to %v, got %v", full, peak)
+	}
+
+	// together they don't go beyond the normal volume
+	font.ChannelPressure(0, 127)
+	font.ChannelKeyPressure(0, 69, 127)
+
+	if peak := level(); !nearLevel(peak, full) {
+		t.Errorf("expected all pressure sources together to keep the peak at %v, got %v", full, peak)
+	}
+
+	// resetting the controllers releases the pressure, but keeps the response
+	font.ChannelKeyPressure(0, 70, 64)
+	font.ChannelMidiControl(0, AllCtrlOff, 0)
+
+	if peak := level(); !nearLevel(peak, soft) || font.ChannelGetPressure(0) != 0 || font.ChannelGetKeyPressure(0, 70) != 0 {
+		t.Errorf("expected the controller reset to bring the peak back to %v, got %v", soft, peak)
+	}
+}
+
+func TestNoteControls(t *testing.T) {
+	font := sineFont(t, nil, nil)
+	defer font.Close()
+
+	font.ChannelNoteOn(0, 69, 1)
+	full, crossings := renderSine(font)
+
+	// controls of another key don't affect the note
+	font.ChannelSetNoteVolume(0, 70, 0.5)
+	font.ChannelSetNotePitchBend(0, 70, 12)
+
+	if peak, n := renderSine(font); !nearLevel(peak, full) || n != crossings {
+		t.Errorf("expected the controls of another key to keep the peak at %v, got %v", full, peak)
+	}
+
+	font.ChannelSetNoteVolume(0, 69, 0.5)
+
+	if peak, _ := renderSine(font); !nearLevel(peak, full/2) {
+		t.Errorf("expected the note volume to lower the peak to %v, got %v", full/2, peak)
+	}
+
+	font.ChannelSetNotePitchBend(0, 69, 12)
+
+	if _, n := renderSine(font); n < crossings*2-2 || n > crossings*2+2 {
+		t.Errorf("expected the pitch bend to double the %d zero crossings, got %d", crossings, n)
+	}
+
+	font.ChannelSetNoteFilter(0, 69, -8400)
+
+	if peak, _ := renderSine(font); peak > full/4 {
+		t.Errorf("expected the note filter to lower the peak below %v, got %v", full/4, peak)
+	}
+
+	// the note off resets the controls, the next note starts with the defaults
+	font.ChannelNoteOff(0, 69)
+	font.ChannelSoundsOffAll(0)
+	font.ChannelNoteOn(0, 69, 1)
+
+	if peak, n := renderSine(font); !nearLevel(peak, full) || n != crossings {
+		t.Errorf("expected a new note to ignore the previous controls, got peak %v", peak)
+	}
+
+	// controls sent before the note on apply to it
+	font.ChannelNoteOff(0, 69)
+	font.ChannelSoundsOffAll(0)
+	font.ChannelSetNoteVolume(0, 69, 0.5)
+	font.ChannelSetNotePitchBend(0, 69, 12)
+	font.ChannelNoteOn(0, 69, 1)
+
+	if peak, n := renderSine(font); !nearLevel(peak, full/2) || n < crossings*2-2 || n > crossings*2+2 {
+		t.Errorf("expected the controls sent before the note on to halve the peak and double the %d zero crossings, got %v and %d", crossings, peak, n)
+	}
+
+	// resetting all controllers brings the playing note back to the defaults
+	font.ChannelMidiControl(0, AllCtrlOff, 0)
+
+	if peak, n := renderSine(font); !nearLevel(peak, full) || n != crossings {
+		t.Errorf("expected the controller reset to bring the peak back to %v, got %v", full, peak)
+	}
+
+	// panning the note hard left silences the right output
+	font.SetOutput(OutputModeStereoInterleaved, 44100, 0)
+	font.ChannelSetNotePan(0, 69, 0)
+	buffer := make([]float32, 4410)
+	font.RenderFloat(buffer, 2205, false)
+
+	for i := 1; i < len(buffer); i += 2 {
+		if buffer[i] != 0 {
+			t.Fatalf("expected the right output to be silent, got %v at frame %d", buffer[i], i/2)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package tsf
+
+// Mute, solo and volume settings of a Player
+// Muted channels and tracks don't start notes, but still apply all other
+// events so they sound right when unmuted. While any channel or track is
+// soloed, only the notes of soloed channels and tracks are played.
+type mixer struct {
+	channelMute, channelSolo [16]bool
+	trackMute, trackSolo     map[int]bool
+	volumes                  [16]float32
+}
+
+func newMixer() mixer {
+	m := mixer{
+		trackMute: map[int]bool{},
+		trackSolo: map[int]bool{},
+	}
+	for channel := range m.volumes {
+		m.volumes[channel] = 1
+	}
+	return m
+}
+
+// Returns true if notes of a channel and track are played
+func (m *mixer) audible(channel, track int) bool {
+	if channel < 0 || channel >= 16 {
+		return true
+	}
+	if m.channelMute[channel] || m.trackMute[track] {
+		return false
+	}
+	return !m.soloing() || m.channelSolo[channel] || m.trackSolo[track]
+}
+
+// Returns true if notes of a channel are played for at least some tracks
+func (m *mixer) channelAudible(channel int) bool {
+	if m.channelMute[channel] {
+		return false
+	}
+	return !m.soloing() || m.channelSolo[channel] || len(m.trackSolo) > 0
+}
+
+func (m *mixer) soloing() bool {
+	for _, solo := range m.channelSolo {
+		if solo {
+			return true
+		}
+	}
+	return len(m.trackSolo) > 0
+}
+
+// Mute or unmute a MIDI channel, releasing its playing notes
+func (p *Player) MuteChannel(channel int, mute bool) {
+	if channel >= 0 && channel < 16 {
+		p.channelMute[channel] = mute
+		p.releaseMuted()
+	}
+}
+
+func (p *Player) ChannelMuted(channel int) bool {
+	return channel >= 0 && channel < 16 && p.channelMute[channel]
+}
+
+// Play only the soloed channels and tracks, releasing the notes of all others
+func (p *Player) SoloChannel(channel int, solo bool) {
+	if channel >= 0 && channel < 16 {
+		p.channelSolo[channel] = solo
+		p.releaseMuted()
+	}
+}
+
+func (p *Player) ChannelSoloed(channel int) bool {
+	return channel >= 0 && channel < 16 && p.channelSolo[channel]
+}
+
+// Mute or unmute a track of the song, releasing its playing notes
+func (p *Player) MuteTrack(track int, mute bool) {
+	if mute {
+		p.trackMute[track] = true
+	} else {
+		delete(p.trackMute, track)
+	}
+	p.releaseMuted()
+}
+
+func (p *Player) TrackMuted(track int) bool {
+	return p.trackMute[track]
+}
+
+// Play only the soloed channels and tracks, releasing the notes of all others
+func (p *Player) SoloTrack(track int, solo bool) {
+	if solo {
+		p.trackSolo[track] = true
+	} else {
+		delete(p.trackSolo, track)
+	}
+	p.releaseMuted()
+}
+
+func (p *Player) TrackSoloed(track int) bool {
+	return p.trackSolo[track]
+}
+
+// volume: linear volume scale factor of a MIDI channel (default 1.0 full)
+// The volume is combined with the volume and expression controllers of the song.
+func (p *Player) SetChannelVolume(channel int, volume float32) {
+	if channel >= 0 && channel < 16 {
+		p.volumes[channel] = volume
+		p.font.ChannelSetMixVolume(channel, volume)
+	}
+}
+
+func (p *Player) ChannelVolume(channel int) float32 {
+	if channel < 0 || channel >= 16 {
+		return 1
+	}
+	return p.volumes[channel]
+}
+
+// Release the playing notes which are no longer audible
+func (p *Player) releaseMuted() {
+	for channel := range p.keys {
+		if !p.channelAudible(channel) {
+			p.font.ChannelNoteOffAll(channel)
+			p.keys[channel] = [128]int16{}
+			continue
+		}
+		for key, played := range p.keys[channel] {
+			if played != 0 && !p.audible(channel, p.keyTracks[channel][key]) {
+				p.noteOff(channel, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package tsf
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMixerMute(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	block := make([]float32, 441*10)
+
+	player.Seek(750*time.Millisecond, true)
+	player.Render(block)
+
+	if font.ActiveVoiceCount() == 0 {
+		t.Fatal("expected the note to play")
+	}
+
+	// muting releases the note
+	player.MuteChannel(0, true)
+
+	for i := 0; font.ActiveVoiceCount() > 0; i++ {
+		if i == 100 {
+			t.Fatal("expected the muted note to end")
+		}
+		player.Render(block)
+	}
+
+	// and keeps it from starting again
+	player.Seek(0, false)
+
+	for i := 0; i < 10; i++ {
+		player.Render(block)
+	}
+
+	if font.ActiveVoiceCount() != 0 || !player.ChannelMuted(0) {
+		t.Error("expected the muted channel to stay silent")
+	}
+}
+
+func TestMixerSolo(t *testing.T) {
+	// two tracks playing the same note at the same time on different channels
+	song, err := ReadMidiMemory(smf(1, 96,
+		"\x00\x90\x3c\x7f\x60\x80\x3c\x40\x00\xff\x2f\x00",
+		"\x00\x91\x3c\x7f\x60\x81\x3c\x40\x00\xff\x2f\x00"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	player.SoloTrack(1, true)
+	player.Render(make([]float32, 441))
+
+	if player.keys[0][60] != 0 || player.keys[1][60] == 0 {
+		t.Error("expected only the soloed track to play")
+	}
+
+	// soloing a channel adds it
+	player.SoloChannel(0, true)
+	player.Seek(0, false)
+	player.Render(make([]float32, 441))
+
+	if player.keys[0][60] == 0 || player.keys[1][60] == 0 {
+		t.Error("expected the soloed channel and track to play")
+	}
+
+	// muting wins over soloing
+	player.MuteTrack(1, true)
+
+	if player.keys[0][60] == 0 || player.keys[1][60] != 0 {
+		t.Error("expected the muted track to be released")
+	}
+}
+
+func TestMixerVolume(t *testing.T) {
+	// volume and expression at half
+	song, err := ReadMidiMemory(smf(0, 96, "\x00\xb0\x07\x40\x00\xb0\x0b\x40\x60\xff\x2f\x00"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	player.SetChannelVolume(0, 0.25)
+	player.Render(make([]float32, 441))
+
+	// the volume goes through decibels
+	if math.Abs(float64(font.ChannelGetMixVolume(0))-0.25) > 1e-5 || font.ChannelGetVolume(0) >= 0.1 {
+		t.Errorf("expected the volume to combine with the controllers, got %v and %v", font.ChannelGetMixVolume(0), font.ChannelGetVolume(0))
+	}
+
+	// the volume survives seeking, which resets the channels
+	player.Seek(0, false)
+
+	if math.Abs(float64(font.ChannelGetMixVolume(0))-0.25) > 1e-5 || player.ChannelVolume(0) != 0.25 {
+		t.Errorf("expected the volume to be kept, got %v", font.ChannelGetMixVolume(0))
+	}
+}
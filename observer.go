@@ -0,0 +1,115 @@
+package tsf
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Selects the events passed to an event handler of a Player
+// Channels only apply to channel messages, meta and system exclusive events
+// pass regardless of them.
+type EventFilter struct {
+	Types    []int // event types to pass, all if empty
+	Channels []int // channels to pass, all if empty
+}
+
+func (f EventFilter) match(e Event) bool {
+	isChannelMessage := e.Type >= NoteOff && e.Type <= PitchBend
+	return matchAny(f.Types, e.Type) && (!isChannelMessage || matchAny(f.Channels, e.Channel))
+}
+
+func matchAny(values []int, value int) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// An event received from an EventStream
+type StreamEvent struct {
+	Event
+	Offset int // frame offset of the event inside the rendered buffer
+}
+
+// Capacity of the channel of an EventStream when no size is given
+const defaultStreamSize = 256
+
+type subscriber struct {
+	filter  EventFilter
+	handler func(e Event, offset int)
+	closed  int32 // set atomically, removed with the next event
+}
+
+// Call handler for each event of the song as it is applied during rendering,
+// with the frame offset of the event inside the rendered buffer
+// The handler runs on the rendering goroutine and must return quickly.
+// Events applied while seeking or restoring the state at a loop start are not
+// passed. Returns a function which removes the handler.
+func (p *Player) OnEvent(filter EventFilter, handler func(e Event, offset int)) (cancel func()) {
+	s := &subscriber{filter: filter, handler: handler}
+	p.subscribers = append(p.subscribers, s)
+	return func() { atomic.StoreInt32(&s.closed, 1) }
+}
+
+// Returns a channel which receives the events of the song as they are applied
+// during rendering, with the frame offset of the event inside the rendered
+// buffer, for goroutines which must not hold up the rendering
+// size is the capacity of the channel, 0 for a default of 256. Events are
+// dropped while the channel is full. The returned function stops the stream
+// and closes the channel, it may be called from any goroutine.
+func (p *Player) EventStream(filter EventFilter, size int) (events <-chan StreamEvent, cancel func()) {
+	if size <= 0 {
+		size = defaultStreamSize
+	}
+	c := make(chan StreamEvent, size)
+	var mutex sync.Mutex // held while sending so the channel isn't closed meanwhile
+	closed := false
+	s := &subscriber{
+		filter: filter,
+		handler: func(e Event, offset int) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if closed {
+				return
+			}
+			select {
+			case c <- StreamEvent{e, offset}:
+			default:
+			}
+		},
+	}
+	p.subscribers = append(p.subscribers, s)
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			atomic.StoreInt32(&s.closed, 1)
+			mutex.Lock()
+			closed = true
+			close(c)
+			mutex.Unlock()
+		})
+	}
+}
+
+// Pass an event to the subscribers, removing the canceled ones
+func (p *Player) notify(e Event, offset int) {
+	subscribers := p.subscribers[:0]
+	for _, s := range p.subscribers {
+		if atomic.LoadInt32(&s.closed) != 0 {
+			continue
+		}
+		if s.filter.match(e) {
+			s.handler(e, offset)
+		}
+		subscribers = append(subscribers, s)
+	}
+	for i := len(subscribers); i < len(p.subscribers); i++ {
+		p.subscribers[i] = nil
+	}
+	p.subscribers = subscribers
+}
@@ -0,0 +1,135 @@
+package tsf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOnEvent(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+
+	type played struct{ block, offset, typ int }
+	var all, notes []played
+	block := 0
+
+	player.OnEvent(EventFilter{}, func(e Event, offset int) {
+		all = append(all, played{block, offset, e.Type})
+	})
+	cancel := player.OnEvent(EventFilter{Types: []int{NoteOn, NoteOff}, Channels: []int{0}}, func(e Event, offset int) {
+		notes = append(notes, played{block, offset, e.Type})
+	})
+	player.OnEvent(EventFilter{Channels: []int{1}}, func(e Event, offset int) {
+		if e.Type < SysEx {
+			t.Errorf("expected no events of channel 0, got %v", e)
+		}
+	})
+
+	buffer := make([]float32, 1000)
+
+	for ; block < 40; block++ {
+		player.Render(buffer)
+		if block == 30 {
+			cancel()
+		}
+	}
+
+	// 0.5s is frame 22050, 1s is frame 44100
+	expected := []played{{0, 0, ProgramChange}, {22, 50, NoteOn}, {44, 100, NoteOff}}
+
+	if !reflect.DeepEqual(all, expected[:2]) {
+		t.Errorf("expected events %v, got %v", expected[:2], all)
+	}
+
+	if !reflect.DeepEqual(notes, expected[1:2]) {
+		t.Errorf("expected note events %v, got %v", expected[1:2], notes)
+	}
+
+	for ; block < 45; block++ {
+		player.Render(buffer)
+	}
+
+	if !reflect.DeepEqual(all, expected) || len(notes) != 1 {
+		t.Errorf("expected events %v and no more notes after canceling, got %v and %v", expected, all, notes)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	events, cancel := player.EventStream(EventFilter{Types: []int{NoteOn, NoteOff}}, 1)
+	buffer := make([]float32, 44100)
+
+	// the note off is dropped as the channel is full
+	player.Render(buffer)
+	player.Render(buffer)
+
+	if e := <-events; e.Type != NoteOn || e.Key() != 60 || e.Offset != 22050 {
+		t.Errorf("expected the note on at offset 22050, got %v", e)
+	}
+
+	// canceled after the end of the song, without another event to apply
+	cancel()
+	cancel()
+
+	if e, ok := <-events; ok {
+		t.Errorf("expected the stream to be closed, got %v", e)
+	}
+
+	// without a size the channel holds both events
+	player.Seek(0, false)
+	events, cancel = player.EventStream(EventFilter{Types: []int{NoteOn, NoteOff}}, 0)
+	defer cancel()
+	player.Render(buffer)
+	player.Render(buffer)
+
+	if len(events) != 2 {
+		t.Errorf("expected 2 events, got %d", len(events))
+	}
+}
+
+func TestEventFilterMeta(t *testing.T) {
+	// tempo and marker on the conductor track, a note on channel 0
+	song, err := ReadMidiMemory(smf(0, 96,
+		"\x00\xff\x51\x03\x07\xa1\x20"+
+			"\x00\xff\x06\x05verse"+
+			"\x00\x90\x3c\x7f"+
+			"\x60\x80\x3c\x40"+
+			"\x00\xff\x2f\x00"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	var types []int
+
+	player.OnEvent(EventFilter{Channels: []int{9}}, func(e Event, offset int) {
+		types = append(types, e.Type)
+	})
+
+	player.Render(make([]float32, 44100))
+
+	if !reflect.DeepEqual(types, []int{SetTempo, Marker}) {
+		t.Errorf("expected the meta events to pass the channel filter, got %v", types)
+	}
+}
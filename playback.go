@@ -0,0 +1,148 @@
+package tsf
+
+import (
+	"sync"
+	"time"
+)
+
+// A Playback plays a Player in real time on its own goroutine, writing
+// blocks of samples to an AudioSink
+// The sink paces the rendering by blocking its writes.
+type Playback struct {
+	mu     sync.Mutex
+	resume *sync.Cond
+	player *Player
+	sink   AudioSink
+
+	frames  int  // per block
+	short   bool // render 16-bit samples
+	paused  bool
+	stopped bool
+	err     error
+	done    chan struct{}
+}
+
+// Start playing in blocks of frames, as float or as 16-bit samples if short is true
+// The player must only be used through Do until the playback has finished.
+func StartPlayback(player *Player, sink AudioSink, frames int, short bool) *Playback {
+	if frames <= 0 {
+		frames = RenderBlockSize
+	}
+	p := &Playback{
+		player: player,
+		sink:   sink,
+		frames: frames,
+		short:  short,
+		done:   make(chan struct{}),
+	}
+	p.resume = sync.NewCond(&p.mu)
+	go p.run()
+	return p
+}
+
+func (p *Playback) run() {
+	defer close(p.done)
+	var buffer []float32
+	var bufferShort []int16
+	if p.short {
+		bufferShort = make([]int16, p.frames*p.player.channels)
+	} else {
+		buffer = make([]float32, p.frames*p.player.channels)
+	}
+	for {
+		p.mu.Lock()
+		for p.paused && !p.stopped {
+			p.resume.Wait()
+		}
+		if p.stopped || p.player.Done() {
+			p.mu.Unlock()
+			return
+		}
+		if p.short {
+			p.player.RenderShort(bufferShort)
+		} else {
+			p.player.Render(buffer)
+		}
+		p.mu.Unlock()
+		var err error
+		if p.short {
+			err = p.sink.WriteShort(bufferShort)
+		} else {
+			err = p.sink.WriteFloat(buffer)
+		}
+		if err != nil {
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Call f with the player while no block is being rendered
+func (p *Playback) Do(f func(player *Player)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f(p.player)
+}
+
+// Stop rendering after the current block, the sink plays what it was given
+func (p *Playback) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = true
+}
+
+func (p *Playback) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = false
+	p.resume.Signal()
+}
+
+func (p *Playback) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// End the playback and wait for the goroutine to finish
+func (p *Playback) Stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.resume.Signal()
+	p.mu.Unlock()
+	<-p.done
+}
+
+// Returns a channel which is closed when the playback has finished, because the
+// song ended, it was stopped or the sink failed
+func (p *Playback) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait for the playback to finish, returns the error of the sink if it failed
+func (p *Playback) Wait() error {
+	<-p.done
+	return p.Err()
+}
+
+// Returns the error of the sink which ended the playback, or nil
+func (p *Playback) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Returns the time of the song being heard, which is behind the time rendered
+// by the latency of the sink
+func (p *Playback) Position() time.Duration {
+	latency := p.sink.Latency()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	position := p.player.Position() - time.Duration(float64(latency)*p.player.TempoScale())
+	if position < 0 {
+		return 0
+	}
+	return position
+}
@@ -0,0 +1,200 @@
+package tsf
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlayback(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeStereoInterleaved)
+	defer font.Close()
+
+	// the same as rendering it directly
+	player := NewPlayer(font, song)
+	var expected []float32
+
+	for block := make([]float32, 2*1000); !player.Done(); {
+		player.Render(block)
+		expected = append(expected, block...)
+	}
+
+	sink := &MemorySink{Delay: 100 * time.Millisecond}
+	playback := StartPlayback(NewPlayer(font, song), sink, 1000, false)
+
+	if err := playback.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(sink.Float, expected) {
+		t.Errorf("expected %d samples like rendering directly, got %d", len(expected), len(sink.Float))
+	}
+
+	// the position is behind by the latency
+	if position := playback.Position(); position != time.Duration(len(expected)/2)*time.Second/44100-100*time.Millisecond {
+		t.Errorf("expected the position to be behind by 100ms, got %v", position)
+	}
+}
+
+func TestPlaybackShort(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	memory := &MemorySink{}
+
+	if err := StartPlayback(NewPlayer(font, song), memory, 0, true).Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	var file bytes.Buffer
+
+	if err := StartPlayback(NewPlayer(font, song), NewFileSink(&file), 0, true).Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(memory.Short) == 0 || file.Len() != 2*len(memory.Short) {
+		t.Errorf("expected %d bytes, got %d", 2*len(memory.Short), file.Len())
+	}
+}
+
+type failingSink struct {
+	MemorySink
+}
+
+var errSink = errors.New("sink failed")
+
+func (s *failingSink) WriteFloat(samples []float32) error {
+	return errSink
+}
+
+func TestPlaybackError(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	if err := StartPlayback(NewPlayer(font, song), &failingSink{}, 0, false).Wait(); err != errSink {
+		t.Errorf("expected the error of the sink, got %v", err)
+	}
+}
+
+// A sink which hands each write to the test, until released
+type steppedSink struct {
+	MemorySink
+	writes  chan struct{}
+	release chan struct{}
+}
+
+func newSteppedSink() *steppedSink {
+	return &steppedSink{writes: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (s *steppedSink) WriteFloat(samples []float32) error {
+	select {
+	case s.writes <- struct{}{}:
+	case <-s.release:
+	}
+	return nil
+}
+
+func TestPlaybackPause(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	sink := newSteppedSink()
+	playback := StartPlayback(NewPlayer(font, song), sink, 441, false)
+
+	for i := 0; i < 10; i++ {
+		<-sink.writes
+	}
+
+	// no block is rendered once Pause returns, a block rendered before may still be written
+	playback.Pause()
+	position := playback.Position()
+
+	select {
+	case <-sink.writes:
+	default:
+	}
+
+	if position < 10*441*time.Second/44100 || playback.Position() != position || !playback.Paused() {
+		t.Errorf("expected the position to stand still while paused, got %v and %v", position, playback.Position())
+	}
+
+	// the second write after resuming was rendered after it
+	playback.Resume()
+	<-sink.writes
+	<-sink.writes
+
+	if playback.Position() <= position {
+		t.Errorf("expected the position to move on after resuming, got %v", playback.Position())
+	}
+
+	playback.Pause()
+	playback.Do(func(player *Player) {
+		player.Seek(0, false)
+	})
+
+	if playback.Position() != 0 {
+		t.Errorf("expected the position to be back at the start, got %v", playback.Position())
+	}
+
+	close(sink.release)
+	playback.Stop()
+
+	select {
+	case <-playback.Done():
+	default:
+		t.Error("expected the playback to be done after stopping")
+	}
+}
+
+func TestNullSink(t *testing.T) {
+	now := time.Now()
+	sink := &NullSink{SampleRate: 1000, Channels: 2, now: func() time.Time { return now }}
+
+	// 100ms, played for 60ms
+	sink.WriteFloat(make([]float32, 2*100))
+	now = now.Add(60 * time.Millisecond)
+
+	if latency := sink.Latency(); latency != 40*time.Millisecond {
+		t.Errorf("expected a latency of 40ms, got %v", latency)
+	}
+
+	// after a pause of a second the next write is paced from then on
+	now = now.Add(time.Second)
+
+	if latency := sink.Latency(); latency != 0 {
+		t.Errorf("expected no latency after an underrun, got %v", latency)
+	}
+
+	sink.WriteFloat(make([]float32, 2*100))
+
+	if latency := sink.Latency(); latency != 100*time.Millisecond {
+		t.Errorf("expected a latency of 100ms after writing again, got %v", latency)
+	}
+}
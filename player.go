@@ -0,0 +1,480 @@
+package tsf
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// General MIDI System On, resets all channels to their defaults
+var gmSystemOn = []byte{0x7E, 0x7F, 0x09, 0x01, 0xF7}
+
+// Master Volume at full volume, the level a GM System On sets
+var gmMasterVolume = []byte{0x7F, 0x7F, 0x04, 0x01, 0x7F, 0x7F, 0xF7}
+
+// How pressure and breath shape the notes of a channel, see SoundFont.ChannelSetPressureResponse
+type pressureResponse struct {
+	vibrato, filter, volume float32
+}
+
+// The pressure response of the channels of a new Player, a vibrato and a
+// brighter sound for key pressure and breath as well, without changing the volume
+var defaultPressureResponse = pressureResponse{vibrato: 50, filter: 1200}
+
+// A Player plays a Song with a SoundFont
+// The player takes over the channels of the SoundFont, which should not be
+// used for anything else while playing. A Player must not be used from
+// multiple goroutines at the same time.
+type Player struct {
+	font SoundFont
+	song *Song
+
+	sampleRate int
+	channels   int  // samples per frame
+	unweaved   bool // render in steps through a scratch buffer
+
+	next       int     // index of the next event to dispatch
+	pos        float64 // frame of the song being rendered next
+	tempoScale float64 // song frames per output frame
+	transpose  int     // semitones
+
+	looping            bool
+	loopDue            bool    // the loop end was reached and playback continues at the loop start
+	loopStart, loopEnd float64 // frames
+	loopCount          int     // remaining repetitions, 0 for endless
+
+	keys      [16][128]int16 // transposed key + 1 of the notes playing on each channel and key
+	keyTracks [16][128]int   // track which started the note playing on each channel and key
+
+	pressureResponses [16]pressureResponse
+
+	mixer
+
+	subscribers []*subscriber
+
+	scratch      []float32
+	scratchShort []int16
+}
+
+// Create a player for a song, using the output settings of the SoundFont
+// Call SetOutput on the SoundFont before creating the player.
+func NewPlayer(font SoundFont, song *Song) *Player {
+	p := &Player{
+		font:       font,
+		song:       song,
+		sampleRate: font.GetSampleRate(),
+		channels:   font.GetOutputChannels(),
+		unweaved:   font.GetOutputMode() == OutputModeStereoUnweaved,
+		tempoScale: 1,
+		mixer:      newMixer(),
+	}
+	for channel := range p.pressureResponses {
+		p.pressureResponses[channel] = defaultPressureResponse
+	}
+	p.resetChannels()
+	return p
+}
+
+// Stop all voices and bring the 16 MIDI channels into their initial state
+func (p *Player) resetChannels() {
+	p.font.Reset()
+	p.font.MidiSysEx(gmSystemOn)
+	p.keys = [16][128]int16{}
+	for channel, volume := range p.volumes {
+		if volume != 1 {
+			p.font.ChannelSetMixVolume(channel, volume)
+		}
+	}
+	for channel, r := range p.pressureResponses {
+		p.font.ChannelSetPressureResponse(channel, r.vibrato, r.filter, r.volume)
+	}
+}
+
+// Bring the 16 MIDI channels into their initial state without ending the notes they play
+func (p *Player) resetControllers() {
+	for channel := 0; channel < 16; channel++ {
+		p.font.ChannelReset(channel)
+	}
+	p.font.MidiSysEx(gmMasterVolume)
+}
+
+// Returns the song being played
+func (p *Player) Song() *Song {
+	return p.song
+}
+
+// Returns the time played so far
+func (p *Player) Position() time.Duration {
+	return p.frameTime(p.pos)
+}
+
+// Change the playback speed relative to the tempo of the song, from 0.25 (a
+// quarter of the tempo) to 4 (four times faster)
+// Tempo changes in the song are scaled as well, the pitch is not affected.
+func (p *Player) SetTempoScale(scale float64) {
+	p.tempoScale = math.Max(0.25, math.Min(4, scale))
+}
+
+func (p *Player) TempoScale() float64 {
+	return p.tempoScale
+}
+
+// Transpose notes on all channels except drum channels by the given semitones
+// Notes which are already playing keep their pitch.
+func (p *Player) SetTranspose(semitones int) {
+	p.transpose = semitones
+}
+
+func (p *Player) Transpose() int {
+	return p.transpose
+}
+
+// Let channel pressure, key pressure and breath shape the notes of a MIDI channel
+// (default: 50 cents vibrato, 1200 cents filter opening and no volume change)
+// Unlike calling SoundFont.ChannelSetPressureResponse directly, this is kept by Seek.
+func (p *Player) SetChannelPressureResponse(channel int, vibrato, filter, volume float32) {
+	if channel >= 0 && channel < 16 {
+		p.pressureResponses[channel] = pressureResponse{vibrato, filter, volume}
+		p.font.ChannelSetPressureResponse(channel, vibrato, filter, volume)
+	}
+}
+
+func (p *Player) ChannelPressureResponse(channel int) (vibrato, filter, volume float32) {
+	if channel < 0 || channel >= 16 {
+		return
+	}
+	r := p.pressureResponses[channel]
+	return r.vibrato, r.filter, r.volume
+}
+
+// Returns the time of the last event of the song
+func (p *Player) Duration() time.Duration {
+	if len(p.song.Events) == 0 {
+		return 0
+	}
+	return seconds(p.song.Events[len(p.song.Events)-1].Seconds)
+}
+
+// Returns true once all events were played and all voices have finished
+func (p *Player) Done() bool {
+	return !p.looping && p.next >= len(p.song.Events) && p.font.ActiveVoiceCount() == 0
+}
+
+// Repeat the part of the song from start to end, count times or endlessly if count is 0
+// When reaching end, playing notes are released so they ring on while the
+// song continues from start with the channels in the state Seek would bring them into.
+func (p *Player) SetLoop(start, end time.Duration, count int) {
+	p.loopStart = p.durationFrame(start)
+	p.loopEnd = p.durationFrame(end)
+	p.loopCount = count
+	p.looping = p.loopEnd > p.loopStart
+	p.loopDue = false
+}
+
+// Repeat the whole song, count times or endlessly if count is 0
+func (p *Player) LoopSong(count int) {
+	p.SetLoop(0, p.Duration(), count)
+}
+
+// Repeat the part of the song between the loop points it defines, which are
+// Marker events named "loopStart" and "loopEnd", or a control change 111
+// (as used by RPG Maker) which loops from there to the end
+// Returns false if the song has no loop points.
+func (p *Player) LoopMarkers(count int) bool {
+	start, end := -1.0, -1.0
+	for _, e := range p.song.Events {
+		switch {
+		case e.Type == Marker && strings.EqualFold(strings.TrimSpace(e.Text()), "loopStart") && start < 0:
+			start = e.Seconds
+		case e.Type == Marker && strings.EqualFold(strings.TrimSpace(e.Text()), "loopEnd") && start >= 0 && end < 0:
+			end = e.Seconds
+		case e.Type == ControlChange && e.Control() == 111 && start < 0:
+			start = e.Seconds
+		}
+	}
+	if start < 0 {
+		return false
+	}
+	if end < 0 {
+		p.SetLoop(seconds(start), p.Duration(), count)
+	} else {
+		p.SetLoop(seconds(start), seconds(end), count)
+	}
+	return p.looping
+}
+
+// Stop looping once the current repetition reached the loop end and play on to the end of the song
+func (p *Player) EndLoop() {
+	p.looping = false
+}
+
+// Jump from the loop end back to the loop start
+func (p *Player) loop() {
+	for channel := 0; channel < 16; channel++ {
+		p.font.ChannelNoteOffAll(channel)
+	}
+	p.keys = [16][128]int16{}
+	// bring the channels to the state at the loop start, letting the released notes ring on
+	p.resetControllers()
+	p.chase(p.loopStart)
+	p.pos += p.loopStart - p.loopEnd // keep the part of the last frame that went past the loop end
+	p.loopDue = false
+	if p.loopCount > 0 {
+		p.loopCount--
+		p.looping = p.loopCount > 0
+	}
+}
+
+// Render the next len(dst) / channels frames of the song
+// dst is laid out according to the output mode of the SoundFont.
+func (p *Player) Render(dst []float32) {
+	frames := len(dst) / p.channels
+	p.render(frames, func(offset, n int) {
+		if !p.unweaved {
+			p.font.RenderFloat(dst[offset*p.channels:], n, false)
+			return
+		}
+		if len(p.scratch) < n*2 {
+			p.scratch = make([]float32, n*2)
+		}
+		p.font.RenderFloat(p.scratch, n, false)
+		copy(dst[offset:offset+n], p.scratch[:n])
+		copy(dst[frames+offset:frames+offset+n], p.scratch[n:n*2])
+	})
+}
+
+// Render the next len(dst) / channels frames of the song as 16-bit samples
+func (p *Player) RenderShort(dst []int16) {
+	frames := len(dst) / p.channels
+	p.render(frames, func(offset, n int) {
+		if !p.unweaved {
+			p.font.RenderShort(dst[offset*p.channels:], n, false)
+			return
+		}
+		if len(p.scratchShort) < n*2 {
+			p.scratchShort = make([]int16, n*2)
+		}
+		p.font.RenderShort(p.scratchShort, n, false)
+		copy(dst[offset:offset+n], p.scratchShort[:n])
+		copy(dst[frames+offset:frames+offset+n], p.scratchShort[n:n*2])
+	})
+}
+
+// Render frames, dispatching every event right before the frame it falls on
+// renderTo renders n frames starting at frame offset of the output.
+func (p *Player) render(frames int, renderTo func(offset, n int)) {
+	for offset := 0; offset < frames; {
+		if p.loopDue && p.looping {
+			p.loop()
+		}
+		events := p.song.Events
+		for p.next < len(events) && p.eventFrame(events[p.next]) <= p.pos {
+			p.dispatch(events[p.next])
+			if len(p.subscribers) > 0 {
+				p.notify(events[p.next], offset)
+			}
+			p.next++
+		}
+		n := frames - offset
+		if p.next < len(events) {
+			n = p.framesUntil(p.eventFrame(events[p.next]), n)
+		}
+		if p.looping && p.pos < p.loopEnd {
+			n = p.framesUntil(p.loopEnd, n)
+		}
+		renderTo(offset, n)
+		offset += n
+		before := p.pos
+		p.pos += float64(n) * p.tempoScale
+		p.loopDue = p.looping && before < p.loopEnd && p.pos >= p.loopEnd
+	}
+}
+
+// Returns the number of output frames until the song reaches frame, at most n
+func (p *Player) framesUntil(frame float64, n int) int {
+	if until := math.Ceil((frame - p.pos) / p.tempoScale); until < float64(n) {
+		return int(until)
+	}
+	return n
+}
+
+// Jump to the time t, bringing all channels into the state they would have
+// after playing the song up to there
+// Programs, banks, controllers (including RPNs), pitch wheels, pressure and
+// system exclusive messages are chased without sounding any notes; tempo changes
+// need no chasing as they are part of the event times. If retrigger is
+// set, notes which started before t and are still held at t are started
+// again, otherwise only notes starting at or after t are heard.
+func (p *Player) Seek(t time.Duration, retrigger bool) {
+	if t < 0 {
+		t = 0
+	}
+	frame := p.durationFrame(t)
+	p.resetChannels()
+	held := p.chase(frame)
+	p.pos = frame
+	p.loopDue = false
+	if !retrigger {
+		return
+	}
+	for channel := range held {
+		for _, index := range held[channel] {
+			if index > 0 {
+				p.noteOn(p.song.Events[index-1])
+			}
+		}
+	}
+}
+
+// Apply the events before frame without sounding or ending any notes, leaving
+// the next event to dispatch at frame
+// Returns the index + 1 of the note on events still held at frame.
+func (p *Player) chase(frame float64) (held [16][128]int) {
+	p.next = 0
+	for events := p.song.Events; p.next < len(events) && p.eventFrame(events[p.next]) < frame; p.next++ {
+		e := events[p.next]
+		switch {
+		case e.Type == NoteOn, e.Type == NoteOff:
+			if e.Channel < 16 && e.Key() < 128 {
+				held[e.Channel][e.Key()] = 0
+				if e.Type == NoteOn && e.Velocity() > 0 {
+					held[e.Channel][e.Key()] = p.next + 1
+				}
+			}
+		case e.Type == ControlChange && (e.Control() == AllSoundOff || e.Control() == AllNotesOff):
+		case e.Type == SysEx && isSystemReset(e.Payload):
+			p.resetControllers() // notes ringing on from before a loop keep playing
+		default:
+			p.dispatch(e)
+		}
+	}
+	return held
+}
+
+// Send an event to the SoundFont
+func (p *Player) dispatch(e Event) {
+	switch e.Type {
+	case NoteOn:
+		if e.Velocity() == 0 {
+			p.noteOff(e.Channel, e.Key())
+			return
+		}
+		p.noteOn(e)
+	case NoteOff:
+		p.noteOff(e.Channel, e.Key())
+	case KeyPressure:
+		p.keyPressure(e.Channel, e.Key(), e.KeyPressure())
+	default:
+		applyEvent(p.font, e)
+	}
+}
+
+// Send an event to a SoundFont
+func applyEvent(f SoundFont, e Event) {
+	switch e.Type {
+	case NoteOn:
+		if e.Velocity() == 0 {
+			f.ChannelNoteOff(e.Channel, e.Key())
+			return
+		}
+		f.ChannelNoteOn(e.Channel, e.Key(), float32(e.Velocity())/127)
+	case NoteOff:
+		f.ChannelNoteOff(e.Channel, e.Key())
+	case ControlChange:
+		f.ChannelMidiControl(e.Channel, e.Control(), e.ControlValue())
+	case ProgramChange:
+		f.ChannelMidiProgram(e.Channel, e.Program())
+	case PitchBend:
+		f.ChannelSetPitchWheel(e.Channel, e.PitchBend())
+	case ChannelPressure:
+		f.ChannelPressure(e.Channel, e.ChannelPressure())
+	case KeyPressure:
+		f.ChannelKeyPressure(e.Channel, e.Key(), e.KeyPressure())
+	case SysEx:
+		f.MidiSysEx(e.Payload)
+	}
+}
+
+// Returns true for the system exclusive messages which reset all channels,
+// GM System On (or GM2 System On), GS Reset and XG System On
+func isSystemReset(d []byte) bool {
+	if len(d) > 0 && d[0] == 0xF0 {
+		d = d[1:]
+	}
+	switch {
+	case len(d) >= 4 && d[0] == 0x7E && d[2] == 0x09 && (d[3] == 0x01 || d[3] == 0x03):
+		return true
+	case len(d) >= 8 && d[0] == 0x41 && d[2] == 0x42 && d[3] == 0x12 && d[4] == 0x40 && d[5] == 0x00 && d[6] == 0x7F && d[7] == 0x00:
+		return true
+	case len(d) >= 7 && d[0] == 0x43 && d[1]&0xF0 == 0x10 && d[2] == 0x4C && d[3] == 0x00 && d[4] == 0x00 && d[5] == 0x7E && d[6] == 0x00:
+		return true
+	}
+	return false
+}
+
+// Start a note, transposed unless it's on a drum channel
+// Notes of muted channels and tracks are skipped.
+func (p *Player) noteOn(e Event) {
+	channel, key := e.Channel, e.Key()
+	if !p.audible(channel, e.Track) {
+		return
+	}
+	played := p.playedKey(channel, key)
+	if played < 0 || played > 127 {
+		return
+	}
+	if channel >= 0 && channel < 16 && key >= 0 && key < 128 {
+		p.keys[channel][key] = int16(played + 1)
+		p.keyTracks[channel][key] = e.Track
+	}
+	p.font.ChannelNoteOn(channel, played, float32(e.Velocity())/127)
+}
+
+// Stop a note with the key it was started with
+func (p *Player) noteOff(channel, key int) {
+	if channel >= 0 && channel < 16 && key >= 0 && key < 128 && p.keys[channel][key] != 0 {
+		played := int(p.keys[channel][key]) - 1
+		p.keys[channel][key] = 0
+		p.font.ChannelNoteOff(channel, played)
+		return
+	}
+	p.font.ChannelNoteOff(channel, key)
+}
+
+// Apply the pressure of a key to the key it was started with, or the key it
+// would be started with now if it isn't playing
+func (p *Player) keyPressure(channel, key, pressure int) {
+	played := p.playedKey(channel, key)
+	if channel >= 0 && channel < 16 && key >= 0 && key < 128 && p.keys[channel][key] != 0 {
+		played = int(p.keys[channel][key]) - 1
+	}
+	if played < 0 || played > 127 {
+		return
+	}
+	p.font.ChannelKeyPressure(channel, played, pressure)
+}
+
+// Returns the key a note is played as, transposed unless it's on a drum channel
+func (p *Player) playedKey(channel, key int) int {
+	if p.font.ChannelGetDrums(channel) {
+		return key
+	}
+	return key + p.transpose
+}
+
+// Returns the frame of the song an event is played at
+func (p *Player) eventFrame(e Event) float64 {
+	return math.Floor(e.Seconds*float64(p.sampleRate) + 0.5)
+}
+
+func (p *Player) durationFrame(t time.Duration) float64 {
+	return float64(int64(t) * int64(p.sampleRate) / int64(time.Second))
+}
+
+func (p *Player) frameTime(frame float64) time.Duration {
+	return time.Duration(frame * float64(time.Second) / float64(p.sampleRate))
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
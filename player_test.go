@@ -0,0 +1,492 @@
+package tsf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func loadFont(t *testing.T, mode OutputMode) SoundFont {
+	font, err := ReadSoundFontFile("winxp.sf2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font.SetOutput(mode, 44100, 0)
+
+	return font
+}
+
+// Returns the first frame which isn't silent
+// Voices start at a level of 0, so the first frame of a note is silent.
+func firstSound(buffer []float32, channels int) int {
+	for i, s := range buffer {
+		if s != 0 {
+			return i / channels
+		}
+	}
+	return -1
+}
+
+// A single piano note from 0.5s to 1s
+var noteSong = smf(0, 96,
+	"\x00\xc0\x00"+
+		"\x60\x90\x3c\x7f"+
+		"\x60\x80\x3c\x40"+
+		"\x00\xff\x2f\x00")
+
+func TestPlayer(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []OutputMode{OutputModeStereoInterleaved, OutputModeStereoUnweaved, OutputModeMono} {
+		font := loadFont(t, mode)
+		player := NewPlayer(font, song)
+
+		if player.Duration() != time.Second {
+			t.Errorf("expected a duration of 1s, got %v", player.Duration())
+		}
+
+		channels := font.GetOutputChannels()
+
+		// odd block size so the note starts in the middle of a block
+		block := make([]float32, 1000*channels)
+		var out []float32
+
+		for i := 0; i < 45; i++ {
+			player.Render(block)
+
+			if mode == OutputModeStereoUnweaved {
+				// only look at the left channel
+				out = append(out, block[:1000]...)
+			} else {
+				out = append(out, block...)
+			}
+		}
+
+		if mode == OutputModeStereoUnweaved {
+			channels = 1
+		}
+
+		if first := firstSound(out, channels); first <= 22050 || first > 22050+4 {
+			t.Errorf("mode %d: expected the note to start at frame 22050, got %d", mode, first)
+		}
+
+		if player.Position() != 45000*time.Second/44100 || player.Done() {
+			t.Errorf("mode %d: expected to be playing at 45000 frames, got %v", mode, player.Position())
+		}
+
+		for i := 0; !player.Done(); i++ {
+			if i == 1000 {
+				t.Fatal("note did not end")
+			}
+			player.Render(block)
+		}
+
+		font.Close()
+	}
+}
+
+func TestPlayerShort(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeStereoInterleaved)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	buffer := make([]int16, 44100*2)
+	player.RenderShort(buffer)
+
+	for i, s := range buffer {
+		if s != 0 {
+			if i/2 <= 22050 || i/2 > 22050+4 {
+				t.Errorf("expected the note to start at frame 22050, got %d", i/2)
+			}
+			break
+		}
+	}
+}
+
+func TestPlayerSeek(t *testing.T) {
+	// program 40 with a pitch bend and volume, then a note from 0.5s to 1s
+	song, err := ReadMidiMemory(smf(0, 96,
+		"\x00\xc0\x28"+
+			"\x00\xe0\x00\x50"+
+			"\x00\xb0\x07\x40"+
+			"\x60\x90\x3c\x7f"+
+			"\x60\x80\x3c\x40"+
+			"\x00\xff\x2f\x00"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeStereoInterleaved)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	block := make([]float32, 2*441)
+
+	for _, retrigger := range []bool{false, true} {
+		// play a bit of something else first
+		font.ChannelMidiProgram(0, 0)
+		font.ChannelNoteOn(0, 50, 1)
+
+		player.Seek(750*time.Millisecond, retrigger)
+
+		if player.Position() != 750*time.Millisecond {
+			t.Errorf("expected to be at 750ms, got %v", player.Position())
+		}
+
+		if font.ChannelGetPresetNumber(0) != 40 || font.ChannelGetPitchWheel(0) != 0x50<<7 {
+			t.Errorf("expected program 40 and the pitch bend, got %d and %d", font.ChannelGetPresetNumber(0), font.ChannelGetPitchWheel(0))
+		}
+
+		// voices stopped by seeking fade out quickly
+		player.Render(block)
+		player.Render(block)
+
+		if sound := firstSound(block, 2) >= 0; sound != retrigger {
+			t.Errorf("retrigger %v: expected sound %v", retrigger, retrigger)
+		}
+	}
+
+	// seeking back to the start plays the note where it belongs
+	player.Seek(0, false)
+
+	var out []float32
+
+	for i := 0; i < 60; i++ {
+		player.Render(block)
+		out = append(out, block...)
+	}
+
+	// the envelope of the violin only opens after the first effect block
+	if first := 2000 + firstSound(out[2*2000:], 2); first <= 22050 || first > 22050+RenderBlockSize+4 {
+		t.Errorf("expected the note to start at frame 22050, got %d", first)
+	}
+}
+
+func TestPlayerLoop(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	player.LoopSong(2)
+	block := make([]float32, 441*25) // 250ms
+
+	var positions []time.Duration
+
+	for i := 0; i < 14; i++ {
+		player.Render(block)
+		positions = append(positions, player.Position()/time.Millisecond)
+	}
+
+	// played three times, then on to the end
+	expected := []time.Duration{250, 500, 750, 1000, 250, 500, 750, 1000, 250, 500, 750, 1000, 1250, 1500}
+
+	if !reflect.DeepEqual(positions, expected) {
+		t.Errorf("expected positions %v, got %v", expected, positions)
+	}
+
+	for i := 0; !player.Done(); i++ {
+		if i == 100 {
+			t.Fatal("expected the song to end")
+		}
+		player.Render(block)
+	}
+
+	// a section marked with markers, the note keeps playing into the loop start
+	song, err = ReadMidiMemory(smf(0, 96,
+		"\x00\x90\x3c\x7f"+
+			"\x30\xff\x06\x09loopStart"+
+			"\x60\xff\x06\x07loopEnd"+
+			"\x30\x80\x3c\x40"+
+			"\x00\xff\x2f\x00"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	player = NewPlayer(font, song)
+
+	if !player.LoopMarkers(0) {
+		t.Fatal("expected loop markers")
+	}
+
+	for i := 0; i < 10; i++ {
+		player.Render(block)
+	}
+
+	if position := player.Position(); position < 250*time.Millisecond || position >= 750*time.Millisecond || player.Done() {
+		t.Errorf("expected to be looping between 250ms and 750ms, got %v", position)
+	}
+
+	player.EndLoop()
+
+	for i := 0; !player.Done(); i++ {
+		if i == 100 {
+			t.Fatal("expected the loop to end")
+		}
+		player.Render(block)
+	}
+
+	// CC111 loops to the end
+	song, err = ReadMidiMemory(smf(0, 96, "\x00\x90\x3c\x7f\x60\xb0\x6f\x00\x60\x80\x3c\x40\x00\xff\x2f\x00"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if player = NewPlayer(font, song); !player.LoopMarkers(1) || player.loopStart != 22050 || player.loopEnd != 44100 {
+		t.Errorf("expected a loop from 0.5s to 1s, got frames %v to %v", player.loopStart, player.loopEnd)
+	}
+}
+
+func TestPlayerLoopReset(t *testing.T) {
+	// program 40 before the loop, volume and pressure set inside it
+	song, err := ReadMidiMemory(smf(0, 96,
+		"\x00\xc0\x28"+
+			"\x00\x90\x3c\x7f"+
+			"\x30\xff\x06\x09loopStart"+
+			"\x30\xb0\x07\x20"+
+			"\x00\xd0\x64"+
+			"\x30\xff\x06\x07loopEnd"+
+			"\x30\x80\x3c\x40"+
+			"\x00\xff\x2f\x00"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	player.LoopMarkers(0)
+	block := make([]float32, 441*25) // 250ms
+
+	for i := 0; i < 3; i++ {
+		player.Render(block)
+	}
+
+	if font.ChannelGetVolume(0) > 0.5 || font.ChannelGetPressure(0) != 100 {
+		t.Fatalf("expected the volume and pressure of the loop, got %v and %d", font.ChannelGetVolume(0), font.ChannelGetPressure(0))
+	}
+
+	// back at the loop start the controllers are those before it
+	player.Render(block)
+
+	if font.ChannelGetVolume(0) < 0.99 || font.ChannelGetPressure(0) != 0 || font.ChannelGetPresetNumber(0) != 40 {
+		t.Errorf("expected full volume, no pressure and program 40, got %v, %d and %d",
+			font.ChannelGetVolume(0), font.ChannelGetPressure(0), font.ChannelGetPresetNumber(0))
+	}
+
+	// the note released at the loop end rings on
+	if firstSound(block, 1) < 0 {
+		t.Error("expected the released note to ring on")
+	}
+}
+
+func TestPlayerLoopSystemReset(t *testing.T) {
+	// a song starting with GM System On, the note released at the loop end
+	song, err := ReadMidiMemory(smf(0, 96,
+		"\x00\xf0\x05\x7e\x7f\x09\x01\xf7"+
+			"\x00\xc0\x28"+
+			"\x00\x90\x3c\x7f"+
+			"\x30\xff\x06\x09loopStart"+
+			"\x30\xff\x06\x07loopEnd"+
+			"\x30\x80\x3c\x40"+
+			"\x00\xff\x2f\x00"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	player.LoopMarkers(0)
+	block := make([]float32, 441*25) // 250ms
+
+	for i := 0; i < 3; i++ {
+		player.Render(block)
+	}
+
+	// chasing the reset at the loop start doesn't end the released note
+	player.Render(block)
+
+	if firstSound(block, 1) < 0 {
+		t.Error("expected the released note to ring on")
+	}
+
+	if font.ChannelGetPresetNumber(0) != 40 {
+		t.Errorf("expected program 40, got %d", font.ChannelGetPresetNumber(0))
+	}
+}
+
+func TestPlayerPressureResponse(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	// renders the note from 0.5s to 1s, returns its peak level
+	level := func(player *Player) (peak float32) {
+		block := make([]float32, 44100)
+		player.Render(block)
+		for _, s := range block[22050:] {
+			if s > peak {
+				peak = s
+			} else if -s > peak {
+				peak = -s
+			}
+		}
+		return peak
+	}
+
+	full := level(NewPlayer(font, song))
+
+	// notes without pressure are 48dB softer, also after seeking
+	player := NewPlayer(font, song)
+	player.SetChannelPressureResponse(0, 0, 0, 48)
+	player.Seek(0, false)
+
+	if peak := level(player); peak > full/100 {
+		t.Errorf("expected the pressure response to lower the peak below %v, got %v", full/100, peak)
+	}
+
+	if vibrato, filter, volume := player.ChannelPressureResponse(0); vibrato != 0 || filter != 0 || volume != 48 {
+		t.Errorf("expected the pressure response 0, 0 and 48, got %v, %v and %v", vibrato, filter, volume)
+	}
+}
+
+func TestPlayerTempoScale(t *testing.T) {
+	song, err := ReadMidiMemory(noteSong)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	player.SetTempoScale(2)
+	block := make([]float32, 1000)
+	var out []float32
+
+	for i := 0; i < 20; i++ {
+		player.Render(block)
+		out = append(out, block...)
+	}
+
+	// twice as fast, the note starts after 0.25s
+	if first := firstSound(out, 1); first <= 11025 || first > 11025+4 {
+		t.Errorf("expected the note to start at frame 11025, got %d", first)
+	}
+
+	if player.Position() != 40000*time.Second/44100 {
+		t.Errorf("expected to be at 40000 frames, got %v", player.Position())
+	}
+
+	if player.SetTempoScale(10); player.TempoScale() != 4 {
+		t.Errorf("expected the scale to be limited to 4, got %v", player.TempoScale())
+	}
+
+	if player.SetTempoScale(0); player.TempoScale() != 0.25 {
+		t.Errorf("expected the scale to be limited to 0.25, got %v", player.TempoScale())
+	}
+}
+
+func TestPlayerTranspose(t *testing.T) {
+	// a piano note on channel 0 and a drum on channel 9, both held to 1s
+	song, err := ReadMidiMemory(smf(0, 96,
+		"\x00\x90\x3c\x7f"+
+			"\x00\x99\x24\x7f"+
+			"\x81\x40\x80\x3c\x40"+
+			"\x00\x89\x24\x40"+
+			"\x00\xff\x2f\x00"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	player.SetTranspose(-5)
+	block := make([]float32, 441)
+	player.Render(block)
+
+	if player.keys[0][60] != 55+1 || player.keys[9][36] != 36+1 {
+		t.Errorf("expected key 60 to play as 55 and the drum untransposed, got %d and %d", player.keys[0][60]-1, player.keys[9][36]-1)
+	}
+
+	// changing the transposition doesn't affect the notes being released
+	player.SetTranspose(3)
+
+	for i := 0; !player.Done(); i++ {
+		if i == 1000 {
+			t.Fatal("expected the notes to end")
+		}
+		player.Render(block)
+	}
+
+	if player.keys[0][60] != 0 || player.keys[9][36] != 0 {
+		t.Error("expected the notes to be released")
+	}
+}
+
+func TestPlayerKeyPressure(t *testing.T) {
+	// key pressure on a piano note held to 1s
+	song, err := ReadMidiMemory(smf(0, 96,
+		"\x00\x90\x3c\x7f"+
+			"\x00\xa0\x3c\x40"+
+			"\x81\x40\x80\x3c\x40"+
+			"\x00\xff\x2f\x00"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	player := NewPlayer(font, song)
+	player.SetTranspose(-5)
+	player.Render(make([]float32, 441))
+
+	if font.ChannelGetKeyPressure(0, 55) != 0x40 || font.ChannelGetKeyPressure(0, 60) != 0 {
+		t.Errorf("expected the key pressure to apply to key 55, got %d", font.ChannelGetKeyPressure(0, 55))
+	}
+
+	// seeking chases the pressure to the transposed key as well
+	for _, retrigger := range []bool{false, true} {
+		player.Seek(500*time.Millisecond, retrigger)
+
+		if font.ChannelGetKeyPressure(0, 55) != 0x40 || font.ChannelGetKeyPressure(0, 60) != 0 {
+			t.Errorf("retrigger %v: expected the chased key pressure to apply to key 55, got %d", retrigger, font.ChannelGetKeyPressure(0, 55))
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package tsf
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// An AudioSink receives rendered samples, laid out according to the output
+// mode of the SoundFont, to play or store them
+// Writes may block to pace the rendering, like an audio device which only
+// accepts samples as fast as it plays them.
+type AudioSink interface {
+	WriteFloat(samples []float32) error
+	WriteShort(samples []int16) error
+	// Returns the time until the samples written last are heard
+	// Called from other goroutines while writing.
+	Latency() time.Duration
+}
+
+// An AudioSink which writes raw little-endian samples, for example to a file
+type FileSink struct {
+	w io.Writer
+}
+
+func NewFileSink(w io.Writer) *FileSink {
+	return &FileSink{w: w}
+}
+
+func (s *FileSink) WriteFloat(samples []float32) error {
+	return binary.Write(s.w, binary.LittleEndian, samples)
+}
+
+func (s *FileSink) WriteShort(samples []int16) error {
+	return binary.Write(s.w, binary.LittleEndian, samples)
+}
+
+func (s *FileSink) Latency() time.Duration {
+	return 0
+}
+
+// An AudioSink which discards all samples
+// With a sample rate set, writes block for as long as playing the samples
+// would take, so a Playback runs in real time without an audio device.
+type NullSink struct {
+	SampleRate int
+	Channels   int // samples per frame
+
+	mu      sync.Mutex
+	start   time.Time
+	written int64            // frames since start
+	now     func() time.Time // time.Now unless replaced by tests
+}
+
+func (s *NullSink) WriteFloat(samples []float32) error {
+	s.wait(len(samples))
+	return nil
+}
+
+func (s *NullSink) WriteShort(samples []int16) error {
+	s.wait(len(samples))
+	return nil
+}
+
+func (s *NullSink) wait(samples int) {
+	if s.SampleRate <= 0 {
+		return
+	}
+	if s.Channels > 0 {
+		samples /= s.Channels
+	}
+	s.mu.Lock()
+	// after an underrun, for example while paused, playing starts over from now
+	if now := s.clock(); s.written == 0 || now.Sub(s.start) >= s.duration(s.written) {
+		s.start = now
+		s.written = 0
+	}
+	s.written += int64(samples)
+	s.mu.Unlock()
+	// stay one write ahead, like a double buffered device
+	if ahead := s.Latency() - time.Duration(samples)*time.Second/time.Duration(s.SampleRate); ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
+
+// Returns the time of the samples written but not played yet
+func (s *NullSink) Latency() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.SampleRate <= 0 || s.written == 0 {
+		return 0
+	}
+	latency := s.duration(s.written) - s.clock().Sub(s.start)
+	if latency < 0 {
+		return 0
+	}
+	return latency
+}
+
+func (s *NullSink) duration(frames int64) time.Duration {
+	return time.Duration(frames) * time.Second / time.Duration(s.SampleRate)
+}
+
+func (s *NullSink) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// An AudioSink which keeps all samples in memory
+type MemorySink struct {
+	Float []float32
+	Short []int16
+	Delay time.Duration // reported as latency
+}
+
+func (s *MemorySink) WriteFloat(samples []float32) error {
+	s.Float = append(s.Float, samples...)
+	return nil
+}
+
+func (s *MemorySink) WriteShort(samples []int16) error {
+	s.Short = append(s.Short, samples...)
+	return nil
+}
+
+func (s *MemorySink) Latency() time.Duration {
+	return s.Delay
+}
@@ -0,0 +1,411 @@
+package tsf
+
+import (
+	"math"
+	"sort"
+)
+
+// A single event of a Song
+// Data1 and Data2 hold the raw message bytes, use the accessors matching Type
+// to read them. Payload holds the data of meta and system exclusive events.
+type Event struct {
+	Time    int     // milliseconds since the start of the song, rounded down
+	Seconds float64 // exact time since the start of the song
+	Tick    int     // ticks since the start of the song
+	Track   int     // index of the MTrk track the event was read from
+	Type    int
+	Channel int // only meaningful for channel messages (NoteOff to PitchBend)
+	Data1   int
+	Data2   int
+	Payload []byte
+}
+
+func (e Event) Key() int             { return e.Data1 }
+func (e Event) Control() int         { return e.Data1 }
+func (e Event) Program() int         { return e.Data1 }
+func (e Event) ChannelPressure() int { return e.Data1 }
+func (e Event) Velocity() int        { return e.Data2 }
+func (e Event) KeyPressure() int     { return e.Data2 }
+func (e Event) ControlValue() int    { return e.Data2 }
+
+// Returns the pitch wheel position (0 to 16383, 8192 is centered)
+func (e Event) PitchBend() int { return e.Data1 }
+
+// Returns the tempo of a SetTempo event in microseconds per quarter note
+func (e Event) Tempo() int { return e.Data1 }
+
+// Returns the text of a meta event (Text, Lyric, Marker, ...)
+// MIDI files don't specify an encoding, it's usually ASCII or Latin-1.
+func (e Event) Text() string { return string(e.Payload) }
+
+// Returns the time at which the track of a SMPTEOffset event starts
+// The frame rate is encoded in the hours byte, see FrameRate.
+func (e Event) SMPTEOffset() (hours, minutes, seconds, frames, subframes int) {
+	if len(e.Payload) < 5 {
+		return
+	}
+	p := e.Payload
+	return int(p[0] & 0x1f), int(p[1]), int(p[2]), int(p[3]), int(p[4])
+}
+
+// Returns the frames per second given in the hours byte of a SMPTEOffset event
+func (e Event) FrameRate() float64 {
+	if len(e.Payload) < 5 {
+		return 0
+	}
+	return smpteFrameRate([]int{24, 25, 29, 30}[e.Payload[0]>>5&3])
+}
+
+// Returns the frames per second of a SMPTE format (24, 25, 29 or 30)
+// Format 29 is 29.97 drop-frame.
+func smpteFrameRate(format int) float64 {
+	if format == 29 {
+		return 30000.0 / 1001
+	}
+	return float64(format)
+}
+
+// Returns the time signature of a TimeSignature event, e.g. 6 and 8 for 6/8
+func (e Event) TimeSignature() (numerator, denominator int) { return e.Data1, e.Data2 }
+
+// Returns the key of a KeySignature event
+// sharps is the number of sharps, or the negated number of flats.
+func (e Event) KeySignature() (sharps int, minor bool) { return e.Data1, e.Data2 != 0 }
+
+// A time ordered list of events
+// Sorting with sort.Stable keeps the order of simultaneous events.
+type Events []Event
+
+func (e Events) Len() int { return len(e) }
+func (e Events) Less(i, j int) bool {
+	if e[i].Time != e[j].Time {
+		return e[i].Time < e[j].Time
+	}
+	return e[i].Seconds < e[j].Seconds
+}
+func (e Events) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+// Returns the index of the first event at or after msec, or len(e) if there is none
+func (e Events) Search(msec int) int {
+	return sort.Search(len(e), func(i int) bool { return e[i].Time >= msec })
+}
+
+// Returns the events from msec "from" up to (but not including) msec "to"
+// The result shares its memory with e.
+func (e Events) Between(from, to int) Events {
+	return e[e.Search(from):e.Search(to)]
+}
+
+// Returns a new list of the events with one of the given types
+func (e Events) Filter(types ...int) Events {
+	var res Events
+	for _, ev := range e {
+		for _, t := range types {
+			if ev.Type == t {
+				res = append(res, ev)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// A Song holds all events of a MIDI file in Go memory
+// It does not need to be closed and can be shared between goroutines as long
+// as none of them modifies it.
+type Song struct {
+	Format   int // 0 = single track, 1 = simultaneous tracks, 2 = independent sequences
+	Division int // ticks per quarter note, 0 for files with SMPTE timing
+
+	// SMPTE frames per second (24, 25, 29.97 or 30) and ticks per frame of
+	// files with SMPTE timing, these don't depend on the tempo
+	FrameRate     float64
+	TicksPerFrame int
+
+	// For format 2 files all sequences one after another
+	Events Events
+
+	sequences []*Song
+}
+
+// The events of one MTrk chunk of a Song
+type Track struct {
+	Index  int
+	Name   string // text of the first TrackName event
+	Events Events
+}
+
+// Returns the tracks of the song, in the order of the file
+func (s *Song) Tracks() []Track {
+	var tracks []Track
+	for _, e := range s.Events {
+		for len(tracks) <= e.Track {
+			tracks = append(tracks, Track{Index: len(tracks)})
+		}
+		t := &tracks[e.Track]
+		if e.Type == TrackName && t.Name == "" {
+			t.Name = e.Text()
+		}
+		t.Events = append(t.Events, e)
+	}
+	return tracks
+}
+
+// Returns a copy of the song with only the events of the given tracks, to play
+// or render a part of it
+// Tempo, signature and SMPTE offset events are kept from all tracks so times
+// and bars stay the same.
+// The tracks of format 2 songs are independent sequences with their own tempo
+// maps, so only the selected sequences are kept, played one after another.
+func (s *Song) SelectTracks(tracks ...int) *Song {
+	selected := *s
+	selected.Events = nil
+	selected.sequences = nil
+	if s.Format == 2 {
+		for _, seq := range s.Sequences() {
+			if len(seq.Events) > 0 && hasTrack(tracks, seq.Events[0].Track) {
+				selected.sequences = append(selected.sequences, seq)
+			}
+		}
+		selected.joinSequences()
+		return &selected
+	}
+	for _, e := range s.Events {
+		switch e.Type {
+		case SetTempo, TimeSignature, KeySignature, SMPTEOffset:
+			selected.Events = append(selected.Events, e)
+			continue
+		}
+		if hasTrack(tracks, e.Track) {
+			selected.Events = append(selected.Events, e)
+		}
+	}
+	return &selected
+}
+
+func hasTrack(tracks []int, track int) bool {
+	for _, t := range tracks {
+		if t == track {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the independent sequences of a format 2 song, each with its own
+// tempo map and times starting at 0
+// Songs of other formats are a single sequence.
+func (s *Song) Sequences() []*Song {
+	if s.sequences == nil {
+		return []*Song{s}
+	}
+	return s.sequences
+}
+
+// Split the events of a format 2 song, which tml.h merged by tick, into its
+// sequences and time each of them separately
+// The events of the song become the sequences played one after another.
+func (s *Song) splitSequences() {
+	var tracks [][]Event
+	for _, e := range s.Events {
+		for len(tracks) <= e.Track {
+			tracks = append(tracks, nil)
+		}
+		tracks[e.Track] = append(tracks[e.Track], e)
+	}
+	s.sequences = nil
+	for _, events := range tracks {
+		if len(events) == 0 {
+			continue
+		}
+		seq := &Song{Format: 2, Division: s.Division, FrameRate: s.FrameRate, TicksPerFrame: s.TicksPerFrame, Events: events}
+		seq.computeSeconds()
+		for i := range seq.Events {
+			seq.Events[i].Time = secondsToTime(seq.Events[i].Seconds)
+		}
+		s.sequences = append(s.sequences, seq)
+	}
+	s.joinSequences()
+}
+
+// Set the events of a format 2 song to its sequences played one after another
+func (s *Song) joinSequences() {
+	s.Events = nil
+	offsetTick, offsetSeconds := 0, 0.0
+	for _, seq := range s.sequences {
+		for _, e := range seq.Events {
+			e.Tick += offsetTick
+			e.Seconds += offsetSeconds
+			e.Time = secondsToTime(e.Seconds)
+			s.Events = append(s.Events, e)
+		}
+		last := seq.Events[len(seq.Events)-1]
+		offsetTick += last.Tick
+		offsetSeconds += last.Seconds
+	}
+}
+
+// Returns the milliseconds of an exact time, rounded down
+func secondsToTime(seconds float64) int {
+	return int(math.Floor(seconds*1000 + 1e-9))
+}
+
+// Returns the Lyric events, or the Text events for files that use those
+// for karaoke lyrics instead
+func (s *Song) Lyrics() Events {
+	if lyrics := s.Events.Filter(Lyric); len(lyrics) > 0 {
+		return lyrics
+	}
+	return s.Events.Filter(Text)
+}
+
+// Returns the Marker events, which usually name the sections of a song
+func (s *Song) Markers() Events {
+	return s.Events.Filter(Marker)
+}
+
+// Returns the time of the last event in milliseconds
+func (s *Song) Duration() int {
+	if len(s.Events) == 0 {
+		return 0
+	}
+	return s.Events[len(s.Events)-1].Time
+}
+
+// The tempo of a song until its first SetTempo event (120 beats per minute)
+const defaultTempo = 500000
+
+// Returns the time in milliseconds of a tick, rounded down like tml.h does
+func (s *Song) tickToTime(tick int) int {
+	if s.FrameRate > 0 {
+		return int(float64(tick) * 1000 / s.ticksPerSecond())
+	}
+	tempoTick, tempoTime, tempo := 0, 0, defaultTempo
+	for _, e := range s.Events {
+		if e.Tick > tick {
+			break
+		}
+		if e.Type == SetTempo {
+			tempoTick, tempoTime, tempo = e.Tick, e.Time, e.Tempo()
+		}
+	}
+	return tempoTime + int(int64(tick-tempoTick)*int64(tempo)/(1000*int64(s.division())))
+}
+
+// Set the Seconds of all events from their ticks and the SetTempo events
+// The events must be in time order.
+func (s *Song) computeSeconds() {
+	if s.FrameRate > 0 {
+		for i := range s.Events {
+			s.Events[i].Seconds = float64(s.Events[i].Tick) / s.ticksPerSecond()
+		}
+		return
+	}
+	tempoTick, tempoSeconds, tempo := 0, 0.0, defaultTempo
+	perTick := 1 / (1e6 * float64(s.division()))
+	for i := range s.Events {
+		e := &s.Events[i]
+		e.Seconds = tempoSeconds + float64(e.Tick-tempoTick)*float64(tempo)*perTick
+		if e.Type == SetTempo {
+			tempoTick, tempoSeconds, tempo = e.Tick, e.Seconds, e.Tempo()
+		}
+	}
+}
+
+// Returns the last tick which starts at or before the time msec
+func (s *Song) timeToTick(msec int) int {
+	if s.FrameRate > 0 {
+		return int(math.Ceil(float64(msec+1)*s.ticksPerSecond()/1000)) - 1
+	}
+	tempoTick, tempoTime, tempo := 0, 0, defaultTempo
+	for _, e := range s.Events {
+		if e.Time > msec {
+			break
+		}
+		if e.Type == SetTempo {
+			tempoTick, tempoTime, tempo = e.Tick, e.Time, e.Tempo()
+		}
+	}
+	return tempoTick + int((int64(msec-tempoTime+1)*1000*int64(s.division())-1)/int64(tempo))
+}
+
+// Returns the ticks per quarter note
+// SMPTE timing doesn't have quarter notes, so bars and beats of such files
+// are based on the default tempo.
+func (s *Song) division() int {
+	switch {
+	case s.FrameRate > 0:
+		return int(s.ticksPerSecond() * defaultTempo / 1e6)
+	case s.Division <= 0:
+		return 96
+	}
+	return s.Division
+}
+
+func (s *Song) ticksPerSecond() float64 {
+	return s.FrameRate * float64(s.TicksPerFrame)
+}
+
+// A stretch of a song with the same time signature
+type meter struct {
+	tick, bar      int // start of the stretch
+	beats, perBeat int // beats per bar and ticks per beat
+}
+
+func (m meter) barTicks() int { return m.beats * m.perBeat }
+
+// Returns the meters of the song, starting with 4/4 until the first TimeSignature event
+// A time signature change in the middle of a bar starts a new bar.
+func (s *Song) meters() []meter {
+	division := s.division()
+	meters := []meter{{0, 1, 4, division}}
+	for _, e := range s.Events {
+		if e.Type != TimeSignature {
+			continue
+		}
+		last := &meters[len(meters)-1]
+		numerator, denominator := e.TimeSignature()
+		next := meter{e.Tick, last.bar, numerator, division * 4 / denominator}
+		if next.beats < 1 {
+			next.beats = 1
+		}
+		if next.perBeat < 1 {
+			next.perBeat = 1
+		}
+		if e.Tick == last.tick {
+			*last = next
+			continue
+		}
+		next.bar += (e.Tick - last.tick + last.barTicks() - 1) / last.barTicks()
+		meters = append(meters, next)
+	}
+	return meters
+}
+
+// Returns the bar and beat (both starting at 1) at the time msec
+func (s *Song) BarBeatAt(msec int) (bar, beat int) {
+	tick := s.timeToTick(msec)
+	meters := s.meters()
+	m := meters[0]
+	for _, next := range meters[1:] {
+		if next.tick > tick {
+			break
+		}
+		m = next
+	}
+	offset := tick - m.tick
+	return m.bar + offset/m.barTicks(), offset%m.barTicks()/m.perBeat + 1
+}
+
+// Returns the time in milliseconds at which a beat of a bar (both starting at 1) begins
+func (s *Song) TimeOfBar(bar, beat int) int {
+	meters := s.meters()
+	m := meters[0]
+	for _, next := range meters[1:] {
+		if next.bar > bar {
+			break
+		}
+		m = next
+	}
+	return s.tickToTime(m.tick + (bar-m.bar)*m.barTicks() + (beat-1)*m.perBeat)
+}
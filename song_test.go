@@ -0,0 +1,379 @@
+package tsf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestSongEvents(t *testing.T) {
+	song, err := ReadMidiFile("expanse.mid")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the song must match the C message list it was copied from
+	msg := LoadMidiFile("expanse.mid")
+
+	for i, e := range song.Events {
+		if msg.IsNil() {
+			t.Fatalf("song has more events than messages (%d)", i)
+		}
+
+		// messages don't know the exact time
+		ev := msg.Event()
+		ev.Seconds = e.Seconds
+
+		if !reflect.DeepEqual(ev, e) || msg.Time() != e.Time || msg.Type() != e.Type {
+			t.Fatalf("event %d: %+v does not match message %+v", i, e, ev)
+		}
+
+		msg = msg.Next()
+	}
+
+	if !msg.IsNil() {
+		t.Fatal("song has fewer events than messages")
+	}
+
+	if !sort.IsSorted(song.Events) {
+		t.Error("events are not in time order")
+	}
+
+	tempos := 0
+
+	for _, e := range song.Events {
+		switch e.Type {
+		case PitchBend:
+			if e.PitchBend() < 0 || e.PitchBend() > 16383 {
+				t.Errorf("pitch bend out of range: %d", e.PitchBend())
+			}
+		case SetTempo:
+			if e.Tempo() <= 0 {
+				t.Errorf("invalid tempo: %d", e.Tempo())
+			}
+			tempos++
+		}
+	}
+
+	if tempos == 0 {
+		t.Error("expected a SetTempo event")
+	}
+
+	// tml.h rounds down at every tempo change
+	for _, e := range song.Events {
+		if msec := e.Seconds * 1000; msec < float64(e.Time)-1e-6 || msec >= float64(e.Time+tempos+1) {
+			t.Fatalf("event at %dms has an exact time of %fms", e.Time, msec)
+		}
+	}
+
+	half := song.Duration() / 2
+	i := song.Events.Search(half)
+
+	if i == 0 || i == len(song.Events) || song.Events[i].Time < half || song.Events[i-1].Time >= half {
+		t.Errorf("Search(%d) returned %d", half, i)
+	}
+
+	for _, e := range song.Events.Between(half, half+1000) {
+		if e.Time < half || e.Time >= half+1000 {
+			t.Errorf("event at %dms outside of range", e.Time)
+		}
+	}
+
+	// read-only use from several goroutines, checked by go test -race
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			song.Events.Search(half)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Build a standard MIDI file from raw track data, which must end with an EndOfTrack event
+func smf(format, division int, tracks ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString("MThd\x00\x00\x00\x06")
+	binary.Write(&b, binary.BigEndian, [3]uint16{uint16(format), uint16(len(tracks)), uint16(division)})
+	for _, track := range tracks {
+		b.WriteString("MTrk")
+		binary.Write(&b, binary.BigEndian, uint32(len(track)))
+		b.WriteString(track)
+	}
+	return b.Bytes()
+}
+
+func TestMetaEvents(t *testing.T) {
+	mid := smf(0, 96,
+		"\x00\xff\x03\x04Song"+
+			"\x00\xff\x06\x05Verse"+
+			"\x00\x90\x3c\x40"+
+			"\x00\xff\x05\x03La "+
+			"\x60\xff\x05\x03la\n"+
+			"\x00\xff\x7f\x03\x00\x00\x41"+ // sequencer specific events are still dropped
+			"\x00\xff\x06\x00"+
+			"\x00\x80\x3c\x40"+
+			"\x00\xff\x2f\x00")
+
+	song, err := ReadMidiMemory(mid)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []int
+	var text []string
+
+	for _, e := range song.Events {
+		types = append(types, e.Type)
+		text = append(text, e.Text())
+	}
+
+	if !reflect.DeepEqual(types, []int{TrackName, Marker, NoteOn, Lyric, Lyric, Marker, NoteOff}) {
+		t.Fatalf("unexpected event types %v", types)
+	}
+
+	if !reflect.DeepEqual(text, []string{"Song", "Verse", "", "La ", "la\n", "", ""}) {
+		t.Errorf("unexpected event text %q", text)
+	}
+
+	if lyrics := song.Lyrics(); len(lyrics) != 2 || lyrics[1].Time != 500 {
+		t.Errorf("unexpected lyrics %+v", lyrics)
+	}
+
+	if markers := song.Markers(); len(markers) != 2 || markers[0].Text() != "Verse" {
+		t.Errorf("unexpected markers %+v", markers)
+	}
+
+	msg := LoadMidiMemory(mid).Next()
+
+	if msg.Type() != Marker || msg.Text() != "Verse" {
+		t.Errorf("expected the Verse marker message, got type %d %q", msg.Type(), msg.Text())
+	}
+}
+
+func TestBarBeat(t *testing.T) {
+	// 4/4 for two bars, a tempo change to 100 bpm, then 6/8 and a key of Bb major
+	mid := smf(0, 96,
+		"\x00\xff\x58\x04\x04\x02\x18\x08"+
+			"\x00\xff\x59\x02\xfe\x00"+
+			"\x86\x00\xff\x51\x03\x09\x27\xc0"+
+			"\x00\xff\x58\x04\x06\x03\x0c\x08"+
+			"\x00\x90\x3c\x40"+
+			"\x60\x80\x3c\x40"+
+			"\x00\xff\x2f\x00")
+
+	song, err := ReadMidiMemory(mid)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if song.Division != 96 {
+		t.Errorf("expected division 96, got %d", song.Division)
+	}
+
+	signatures := song.Events.Filter(TimeSignature, KeySignature)
+
+	if len(signatures) != 3 {
+		t.Fatalf("expected 3 signatures, got %+v", signatures)
+	}
+
+	if n, d := signatures[2].TimeSignature(); n != 6 || d != 8 {
+		t.Errorf("expected 6/8, got %d/%d", n, d)
+	}
+
+	if sharps, minor := signatures[1].KeySignature(); sharps != -2 || minor {
+		t.Errorf("expected Bb major, got %d %v", sharps, minor)
+	}
+
+	// 2 bars of 4/4 at 120 bpm take 4s, then a beat (eighth note) of 6/8 at 100 bpm takes 300ms
+	for _, c := range []struct{ msec, bar, beat int }{
+		{0, 1, 1},
+		{499, 1, 1},
+		{500, 1, 2},
+		{2000, 2, 1},
+		{3999, 2, 4},
+		{4000, 3, 1},
+		{4300, 3, 2},
+		{5799, 3, 6},
+		{5800, 4, 1},
+	} {
+		if bar, beat := song.BarBeatAt(c.msec); bar != c.bar || beat != c.beat {
+			t.Errorf("BarBeatAt(%d) = %d, %d, expected %d, %d", c.msec, bar, beat, c.bar, c.beat)
+		}
+
+		if c.msec%100 == 0 {
+			if msec := song.TimeOfBar(c.bar, c.beat); msec != c.msec {
+				t.Errorf("TimeOfBar(%d, %d) = %d, expected %d", c.bar, c.beat, msec, c.msec)
+			}
+		}
+	}
+
+	// the last event (note off) is at tick 864, 2 beats into bar 3
+	last := song.Events[len(song.Events)-1]
+
+	if msec := song.TimeOfBar(3, 3); msec != last.Time {
+		t.Errorf("expected bar 3 beat 3 at %d, got %d", last.Time, msec)
+	}
+
+	if last.Tick != 864 || math.Abs(last.Seconds-4.6) > 1e-9 {
+		t.Errorf("expected the last event at tick 864 and 4.6s, got %d and %v", last.Tick, last.Seconds)
+	}
+}
+
+func TestTracks(t *testing.T) {
+	// 1/3ms per tick, which tml.h can't represent
+	mid := smf(1, 1500,
+		"\x00\xff\x03\x09Conductor"+
+			"\x00\xff\x2f\x00",
+		"\x00\x90\x3c\x40"+
+			"\x01\x80\x3c\x40"+
+			"\x01\x90\x3e\x40"+
+			"\x00\xff\x2f\x00",
+		"\x01\x90\x40\x40"+
+			"\x01\x80\x40\x40"+
+			"\x00\xff\x2f\x00")
+
+	song, err := ReadMidiMemory(mid)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct{ tick, track, msec int }{
+		{0, 0, 0}, {0, 1, 0}, {1, 1, 0}, {1, 2, 0}, {2, 1, 0}, {2, 2, 0},
+	}
+
+	if len(song.Events) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), song.Events)
+	}
+
+	for i, e := range song.Events {
+		if e.Tick != expected[i].tick || e.Track != expected[i].track || e.Time != expected[i].msec {
+			t.Errorf("event %d: expected tick %d of track %d, got %+v", i, expected[i].tick, expected[i].track, e)
+		}
+
+		if seconds := float64(e.Tick) / 3000; math.Abs(e.Seconds-seconds) > 1e-12 {
+			t.Errorf("event %d: expected %vs, got %vs", i, seconds, e.Seconds)
+		}
+	}
+
+	if msg := LoadMidiMemory(mid).Next().Next(); msg.Track() != 1 || msg.Tick() != 1 {
+		t.Errorf("expected message at tick 1 of track 1, got %d of track %d", msg.Tick(), msg.Track())
+	}
+	tracks := song.Tracks()
+
+	if len(tracks) != 3 || tracks[0].Name != "Conductor" || len(tracks[1].Events) != 3 || tracks[2].Index != 2 {
+		t.Errorf("unexpected tracks %+v", tracks)
+	}
+
+	part := song.SelectTracks(0, 2)
+
+	if len(part.Events) != 3 || part.Events[1].Track != 2 || len(song.Events) != 6 {
+		t.Errorf("unexpected events of tracks 0 and 2: %+v", part.Events)
+	}
+}
+
+func TestSequences(t *testing.T) {
+	// the second sequence runs at 60 bpm, which must not affect the first one
+	mid := smf(2, 96,
+		"\x00\x90\x3c\x40"+
+			"\x60\x80\x3c\x40"+
+			"\x00\xff\x2f\x00",
+		"\x00\xff\x51\x03\x0f\x42\x40"+
+			"\x00\x90\x3e\x40"+
+			"\x30\x80\x3e\x40"+
+			"\x00\xff\x2f\x00")
+
+	song, err := ReadMidiMemory(mid)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sequences := song.Sequences()
+
+	if song.Format != 2 || len(sequences) != 2 {
+		t.Fatalf("expected 2 sequences in a format 2 song, got %d", len(sequences))
+	}
+
+	if e := sequences[0].Events[1]; e.Type != NoteOff || e.Time != 500 {
+		t.Errorf("expected the first sequence to end at 500ms, got %+v", e)
+	}
+
+	if e := sequences[1].Events[2]; e.Type != NoteOff || e.Time != 500 || e.Tick != 48 {
+		t.Errorf("expected the second sequence to end at 500ms, got %+v", e)
+	}
+
+	// played one after another
+	var times []int
+
+	for _, e := range song.Events {
+		times = append(times, e.Time)
+	}
+
+	if !reflect.DeepEqual(times, []int{0, 500, 500, 500, 1000}) {
+		t.Errorf("unexpected times of the song %v", times)
+	}
+
+	if len(song.SelectTracks(1).Sequences()) != 1 || len(sequences[1].Sequences()) != 1 {
+		t.Error("expected a single sequence")
+	}
+
+	// selecting a sequence doesn't pull in the tempo map of the others
+	first := song.SelectTracks(0)
+
+	if len(first.Events) != 2 || first.Events[1].Time != 500 || len(first.Events.Filter(SetTempo)) != 0 {
+		t.Errorf("expected only the events of the first sequence, got %+v", first.Events)
+	}
+
+	if e := song.SelectTracks(1).Events[2]; e.Type != NoteOff || e.Time != 500 || e.Tick != 48 {
+		t.Errorf("expected the second sequence to start at 0 and end at 500ms, got %+v", e)
+	}
+}
+
+func TestSMPTE(t *testing.T) {
+	// 29.97 drop-frame with 40 ticks per frame, the tempo must not matter
+	mid := smf(0, 0xe328,
+		"\x00\xff\x54\x05\x21\x00\x00\x02\x00"+
+			"\x00\xff\x51\x03\x01\x00\x00"+
+			"\x00\x90\x3c\x40"+
+			"\xdd\x60\x80\x3c\x40"+
+			"\x00\xff\x2f\x00")
+
+	song, err := ReadMidiMemory(mid)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if song.Division != 0 || song.TicksPerFrame != 40 || math.Abs(song.FrameRate-29.97) > 0.001 {
+		t.Errorf("unexpected timing: %d ticks per quarter, %d ticks per frame at %v fps", song.Division, song.TicksPerFrame, song.FrameRate)
+	}
+
+	offset := song.Events[0]
+
+	if offset.Type != SMPTEOffset || offset.FrameRate() != 25 {
+		t.Fatalf("expected a SMPTE offset at 25 fps, got %+v", offset)
+	}
+
+	if h, m, s, f, sf := offset.SMPTEOffset(); h != 1 || m != 0 || s != 0 || f != 2 || sf != 0 {
+		t.Errorf("expected 01:00:00:02.00, got %02d:%02d:%02d:%02d.%02d", h, m, s, f, sf)
+	}
+
+	// 300 frames take 10.01s
+	last := song.Events[len(song.Events)-1]
+
+	if last.Tick != 12000 || math.Abs(last.Seconds-10.01) > 1e-9 || last.Time != 10010 && last.Time != 10009 {
+		t.Errorf("expected the last event at 10.01s, got %+v", last)
+	}
+}
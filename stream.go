@@ -0,0 +1,84 @@
+package tsf
+
+import "C"
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"unsafe"
+)
+
+// The tsf_stream and tml_stream callbacks receive a handle into this table
+// as their data pointer, Go pointers can't be passed through C.
+var (
+	streamsMutex sync.Mutex
+	streams      = map[uintptr]*readerStream{}
+	streamsNext  uintptr
+)
+
+type readerStream struct {
+	r   io.Reader
+	err error
+}
+
+func registerStream(r io.Reader) (uintptr, *readerStream) {
+	s := &readerStream{r: r}
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	streamsNext++
+	streams[streamsNext] = s
+	return streamsNext, s
+}
+
+func unregisterStream(handle uintptr) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	delete(streams, handle)
+}
+
+func lookupStream(data unsafe.Pointer) *readerStream {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	return streams[uintptr(data)]
+}
+
+// Keep the first I/O error so it can be reported instead of the resulting format error
+func (s *readerStream) fail(err error) {
+	if s.err == nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		s.err = err
+	}
+}
+
+//export goStreamRead
+func goStreamRead(data unsafe.Pointer, ptr unsafe.Pointer, size C.uint) C.int {
+	s := lookupStream(data)
+	if s == nil || size == 0 {
+		return 0
+	}
+	buf := (*[1 << 30]byte)(ptr)[:size:size]
+	n, err := io.ReadFull(s.r, buf)
+	if err != nil {
+		s.fail(err)
+	}
+	return C.int(n)
+}
+
+//export goStreamSkip
+func goStreamSkip(data unsafe.Pointer, count C.uint) C.int {
+	s := lookupStream(data)
+	if s == nil {
+		return 0
+	}
+	var err error
+	if seeker, ok := s.r.(io.Seeker); ok {
+		_, err = seeker.Seek(int64(count), io.SeekCurrent)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, s.r, int64(count))
+	}
+	if err != nil {
+		s.fail(err)
+		return 0
+	}
+	return 1
+}
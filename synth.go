@@ -0,0 +1,282 @@
+package tsf
+
+import (
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A time in output frames since a Synth started rendering
+type SampleTime int64
+
+// A Synth plays a SoundFont live, with note and control functions which may
+// be called from any goroutine while another goroutine renders
+// Instead of changing the SoundFont right away, calls are queued without
+// locking and applied in order at the start of the next rendered block, so
+// rendering never waits for a mutex and voices are never reallocated while
+// rendering. Events passed to Schedule are applied at their exact frame
+// instead. Only one goroutine may render at a time.
+type Synth struct {
+	font  SoundFont
+	queue commandQueue
+	time  int64 // SampleTime of the next frame rendered, set atomically
+
+	scheduled    []*command // sorted by time
+	scratch      []float32
+	scratchShort []int16
+}
+
+type command struct {
+	next  *command
+	apply func(f SoundFont)
+	at    SampleTime // for scheduled events
+	event Event
+}
+
+// A lock-free queue of commands for any number of producers and one consumer
+type commandQueue struct {
+	head unsafe.Pointer // *command pushed last
+}
+
+func (q *commandQueue) push(c *command) {
+	for {
+		head := atomic.LoadPointer(&q.head)
+		c.next = (*command)(head)
+		if atomic.CompareAndSwapPointer(&q.head, head, unsafe.Pointer(c)) {
+			return
+		}
+	}
+}
+
+// Remove all commands, returns them in the order they were pushed
+func (q *commandQueue) takeAll() *command {
+	c := (*command)(atomic.SwapPointer(&q.head, nil))
+	var first *command
+	for c != nil {
+		next := c.next
+		c.next = first
+		first = c
+		c = next
+	}
+	return first
+}
+
+// Create a synth playing a SoundFont
+// Set up the output of the SoundFont first, afterwards it should only be
+// changed through Do.
+func NewSynth(font SoundFont) *Synth {
+	return &Synth{font: font}
+}
+
+// Queue a function which changes the SoundFont, for everything without a
+// function of its own
+func (s *Synth) Do(f func(font SoundFont)) {
+	s.queue.push(&command{apply: f})
+}
+
+// Queue an event to be applied right before the frame at time
+// Events with the same time are applied in the order they were scheduled,
+// events scheduled for a time already rendered are applied with the next block.
+// The payload of the event must not be changed afterwards.
+func (s *Synth) Schedule(at SampleTime, e Event) {
+	s.queue.push(&command{at: at, event: e})
+}
+
+// Returns the time of the next frame to be rendered
+func (s *Synth) Time() SampleTime {
+	return SampleTime(atomic.LoadInt64(&s.time))
+}
+
+// Apply the queued commands and move scheduled events into place
+func (s *Synth) flush() {
+	for c := s.queue.takeAll(); c != nil; {
+		next := c.next
+		if c.apply != nil {
+			c.apply(s.font)
+		} else {
+			s.schedule(c)
+		}
+		c = next
+	}
+}
+
+func (s *Synth) schedule(c *command) {
+	i := sort.Search(len(s.scheduled), func(i int) bool { return s.scheduled[i].at > c.at })
+	s.scheduled = append(s.scheduled, nil)
+	copy(s.scheduled[i+1:], s.scheduled[i:])
+	s.scheduled[i] = c
+}
+
+// Apply the queued commands and render output samples into a buffer
+// Scheduled events split the buffer to be applied right at their frame.
+// See SoundFont.RenderFloat.
+func (s *Synth) RenderFloat(dst []float32, samples int, mix bool) {
+	channels := s.font.GetOutputChannels()
+	unweaved := s.font.GetOutputMode() == OutputModeStereoUnweaved
+	s.render(samples, func(offset, n int) {
+		if !unweaved || n == samples {
+			s.font.RenderFloat(dst[offset*channels:], n, mix)
+			return
+		}
+		if len(s.scratch) < n*2 {
+			s.scratch = make([]float32, n*2)
+		}
+		if mix {
+			copy(s.scratch[:n], dst[offset:offset+n])
+			copy(s.scratch[n:n*2], dst[samples+offset:samples+offset+n])
+		}
+		s.font.RenderFloat(s.scratch, n, mix)
+		copy(dst[offset:offset+n], s.scratch[:n])
+		copy(dst[samples+offset:samples+offset+n], s.scratch[n:n*2])
+	})
+}
+
+// Apply the queued commands and render output samples into a buffer
+// Scheduled events split the buffer to be applied right at their frame.
+// See SoundFont.RenderShort.
+func (s *Synth) RenderShort(dst []int16, samples int, mix bool) {
+	channels := s.font.GetOutputChannels()
+	unweaved := s.font.GetOutputMode() == OutputModeStereoUnweaved
+	s.render(samples, func(offset, n int) {
+		if !unweaved || n == samples {
+			s.font.RenderShort(dst[offset*channels:], n, mix)
+			return
+		}
+		if len(s.scratchShort) < n*2 {
+			s.scratchShort = make([]int16, n*2)
+		}
+		if mix {
+			copy(s.scratchShort[:n], dst[offset:offset+n])
+			copy(s.scratchShort[n:n*2], dst[samples+offset:samples+offset+n])
+		}
+		s.font.RenderShort(s.scratchShort, n, mix)
+		copy(dst[offset:offset+n], s.scratchShort[:n])
+		copy(dst[samples+offset:samples+offset+n], s.scratchShort[n:n*2])
+	})
+}
+
+// Render frames, applying every scheduled event right before its frame
+// renderTo renders n frames starting at frame offset of the output.
+func (s *Synth) render(frames int, renderTo func(offset, n int)) {
+	s.flush()
+	time := s.Time()
+	for offset := 0; offset < frames; {
+		applied := 0
+		for ; applied < len(s.scheduled) && s.scheduled[applied].at <= time; applied++ {
+			applyEvent(s.font, s.scheduled[applied].event)
+			s.scheduled[applied] = nil
+		}
+		s.scheduled = s.scheduled[applied:]
+		n := frames - offset
+		if len(s.scheduled) > 0 && s.scheduled[0].at-time < SampleTime(n) {
+			n = int(s.scheduled[0].at - time)
+		}
+		renderTo(offset, n)
+		offset += n
+		time += SampleTime(n)
+		atomic.StoreInt64(&s.time, int64(time))
+	}
+}
+
+// Stop all playing notes immediately and reset all channel parameters
+func (s *Synth) Reset() {
+	s.Do(func(f SoundFont) { f.Reset() })
+}
+
+func (s *Synth) NoteOn(preset, key int, velocity float32) {
+	s.Do(func(f SoundFont) { f.NoteOn(preset, key, velocity) })
+}
+
+func (s *Synth) BankNoteOn(bank, preset, key int, velocity float32) {
+	s.Do(func(f SoundFont) { f.BankNoteOn(bank, preset, key, velocity) })
+}
+
+func (s *Synth) NoteOff(preset, key int) {
+	s.Do(func(f SoundFont) { f.NoteOff(preset, key) })
+}
+
+func (s *Synth) BankNoteOff(bank, preset, key int) {
+	s.Do(func(f SoundFont) { f.BankNoteOff(bank, preset, key) })
+}
+
+func (s *Synth) NoteOffAll() {
+	s.Do(func(f SoundFont) { f.NoteOffAll() })
+}
+
+func (s *Synth) ChannelSetPresetIndex(channel, preset int) {
+	s.Do(func(f SoundFont) { f.ChannelSetPresetIndex(channel, preset) })
+}
+
+func (s *Synth) ChannelSetBankPreset(channel, bank, preset int) {
+	s.Do(func(f SoundFont) { f.ChannelSetBankPreset(channel, bank, preset) })
+}
+
+func (s *Synth) ChannelSetPan(channel int, pan float32) {
+	s.Do(func(f SoundFont) { f.ChannelSetPan(channel, pan) })
+}
+
+func (s *Synth) ChannelSetVolume(channel int, volume float32) {
+	s.Do(func(f SoundFont) { f.ChannelSetVolume(channel, volume) })
+}
+
+func (s *Synth) ChannelSetPitchWheel(channel, pitch int) {
+	s.Do(func(f SoundFont) { f.ChannelSetPitchWheel(channel, pitch) })
+}
+
+func (s *Synth) ChannelNoteOn(channel, key int, velocity float32) {
+	s.Do(func(f SoundFont) { f.ChannelNoteOn(channel, key, velocity) })
+}
+
+func (s *Synth) ChannelNoteOff(channel, key int) {
+	s.Do(func(f SoundFont) { f.ChannelNoteOff(channel, key) })
+}
+
+func (s *Synth) ChannelNoteOffAll(channel int) {
+	s.Do(func(f SoundFont) { f.ChannelNoteOffAll(channel) })
+}
+
+func (s *Synth) ChannelSoundsOffAll(channel int) {
+	s.Do(func(f SoundFont) { f.ChannelSoundsOffAll(channel) })
+}
+
+func (s *Synth) ChannelMidiControl(channel, controller, value int) {
+	s.Do(func(f SoundFont) { f.ChannelMidiControl(channel, controller, value) })
+}
+
+func (s *Synth) ChannelPressure(channel, pressure int) {
+	s.Do(func(f SoundFont) { f.ChannelPressure(channel, pressure) })
+}
+
+func (s *Synth) ChannelKeyPressure(channel, key, pressure int) {
+	s.Do(func(f SoundFont) { f.ChannelKeyPressure(channel, key, pressure) })
+}
+
+func (s *Synth) ChannelSetPressureResponse(channel int, vibrato, filter, volume float32) {
+	s.Do(func(f SoundFont) { f.ChannelSetPressureResponse(channel, vibrato, filter, volume) })
+}
+
+func (s *Synth) ChannelSetNotePitchBend(channel, key int, semitones float32) {
+	s.Do(func(f SoundFont) { f.ChannelSetNotePitchBend(channel, key, semitones) })
+}
+
+func (s *Synth) ChannelSetNoteVolume(channel, key int, volume float32) {
+	s.Do(func(f SoundFont) { f.ChannelSetNoteVolume(channel, key, volume) })
+}
+
+func (s *Synth) ChannelSetNotePan(channel, key int, pan float32) {
+	s.Do(func(f SoundFont) { f.ChannelSetNotePan(channel, key, pan) })
+}
+
+func (s *Synth) ChannelSetNoteFilter(channel, key int, cents float32) {
+	s.Do(func(f SoundFont) { f.ChannelSetNoteFilter(channel, key, cents) })
+}
+
+func (s *Synth) ChannelMidiProgram(channel, program int) {
+	s.Do(func(f SoundFont) { f.ChannelMidiProgram(channel, program) })
+}
+
+// The data is copied, so the caller may reuse it
+func (s *Synth) MidiSysEx(data []byte) {
+	data = append([]byte(nil), data...)
+	s.Do(func(f SoundFont) { f.MidiSysEx(data) })
+}
@@ -0,0 +1,143 @@
+package tsf
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSynth(t *testing.T) {
+	font := loadFont(t, OutputModeMono)
+	defer font.Close()
+
+	synth := NewSynth(font)
+	buffer := make([]float32, RenderBlockSize)
+
+	synth.ChannelMidiProgram(0, 40)
+	synth.ChannelNoteOn(0, 60, 1)
+
+	// nothing changes until rendering
+	if font.ChannelGetPresetNumber(0) == 40 || font.ActiveVoiceCount() != 0 {
+		t.Error("expected the commands to wait for rendering")
+	}
+
+	synth.RenderFloat(buffer, RenderBlockSize, false)
+
+	if font.ChannelGetPresetNumber(0) != 40 || font.ActiveVoiceCount() == 0 {
+		t.Error("expected the commands to be applied")
+	}
+
+	// applied in order
+	synth.ChannelNoteOff(0, 60)
+	synth.ChannelNoteOn(0, 62, 1)
+	synth.RenderFloat(buffer, RenderBlockSize, false)
+
+	if font.ActiveVoiceCount() == 0 {
+		t.Error("expected the second note to play")
+	}
+}
+
+func TestSynthConcurrent(t *testing.T) {
+	font := loadFont(t, OutputModeStereoInterleaved)
+	defer font.Close()
+
+	synth := NewSynth(font)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for channel := 0; channel < 8; channel++ {
+		wg.Add(1)
+		go func(channel int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				synth.ChannelNoteOn(channel, 40+i%40, 0.5)
+				synth.ChannelMidiControl(channel, 10, i%128)
+				synth.ChannelNoteOff(channel, 40+i%40)
+			}
+		}(channel)
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	buffer := make([]int16, 2*RenderBlockSize)
+	for rendering := true; rendering; {
+		select {
+		case <-done:
+			rendering = false
+		default:
+		}
+		synth.RenderShort(buffer, RenderBlockSize, false)
+	}
+
+	// every note was released
+	for i := 0; font.ActiveVoiceCount() > 0; i++ {
+		if i == 10000 {
+			t.Fatal("expected all notes to end")
+		}
+		synth.RenderShort(buffer, RenderBlockSize, false)
+	}
+}
+
+func TestSynthSchedule(t *testing.T) {
+	for _, mode := range []OutputMode{OutputModeStereoInterleaved, OutputModeStereoUnweaved, OutputModeMono} {
+		font := loadFont(t, mode)
+		synth := NewSynth(font)
+		synth.ChannelMidiProgram(0, 0)
+
+		// scheduled out of order, the note off comes first
+		synth.Schedule(3000, Event{Type: NoteOff, Data1: 60})
+		synth.Schedule(1000, Event{Type: NoteOn, Data1: 60, Data2: 127})
+
+		channels := font.GetOutputChannels()
+		buffer := make([]float32, 4096*channels)
+		synth.RenderFloat(buffer, 4096, false)
+
+		if mode == OutputModeStereoUnweaved {
+			// only look at the left channel
+			buffer = buffer[:4096]
+			channels = 1
+		}
+
+		if first := firstSound(buffer, channels); first <= 1000 || first > 1000+4 {
+			t.Errorf("mode %d: expected the note to start at frame 1000, got %d", mode, first)
+		}
+
+		if synth.Time() != 4096 || len(synth.scheduled) != 0 {
+			t.Errorf("mode %d: expected all events to be applied by frame 4096, got %d", mode, synth.Time())
+		}
+
+		// events in the past are applied right away
+		synth.Schedule(0, Event{Type: ProgramChange, Data1: 40})
+		synth.RenderFloat(buffer, 1, false)
+
+		if font.ChannelGetPresetNumber(0) != 40 {
+			t.Errorf("mode %d: expected the program change to be applied", mode)
+		}
+
+		font.Close()
+	}
+}
+
+func TestSynthScheduleShort(t *testing.T) {
+	font := loadFont(t, OutputModeStereoUnweaved)
+	defer font.Close()
+
+	synth := NewSynth(font)
+	synth.ChannelMidiProgram(0, 0)
+	synth.Schedule(500, Event{Type: NoteOn, Data1: 60, Data2: 127})
+
+	buffer := make([]int16, 2*1000)
+	synth.RenderShort(buffer, 1000, false)
+
+	for i, s := range buffer[:1000] {
+		if s != 0 {
+			if i <= 500 || i > 500+4 {
+				t.Errorf("expected the note to start at frame 500, got %d", i)
+			}
+			return
+		}
+	}
+	t.Error("expected the note to play")
+}
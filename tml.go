@@ -2,9 +2,35 @@ package tsf
 
 //#define TML_STATIC 1
 //#define TML_IMPLEMENTATION
+//#include <stdint.h>
+//#include <stdlib.h>
 //#include "tml.h"
+//
+//static tml_message* tml_load_memory_ex(const void* buffer, int size, struct tml_header* header, struct tml_error* error)
+//{
+//	struct tml_stream stream = { TML_NULL, (int(*)(void*,void*,unsigned int))&tml_stream_memory_read };
+//	struct tml_stream_memory f = { (const char*)buffer, (unsigned int)size, 0 };
+//	stream.data = &f;
+//	return tml_load_ex(&stream, header, error);
+//}
+//
+//extern int goStreamRead(void* data, void* ptr, unsigned int size);
+//
+//static tml_message* tml_load_go_stream(uintptr_t handle, struct tml_header* header, struct tml_error* error)
+//{
+//	struct tml_stream stream = { (void*)handle, &goStreamRead };
+//	return tml_load_ex(&stream, header, error);
+//}
 import "C"
 
+import (
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"unsafe"
+)
+
 //https://www.midi.org/specifications
 
 const (
@@ -16,6 +42,22 @@ const (
 	ChannelPressure = 0xD0
 	PitchBend       = 0xE0
 	SetTempo        = 0x51
+	SysEx           = 0xF0 // system exclusive message, Payload holds the data after the status byte
+	SysExEscape     = 0xF7 // continued system exclusive message or escaped raw bytes
+)
+
+// Meta message types, the text of Text to CuePoint is returned by Text
+const (
+	Text           = 0x01
+	Copyright      = 0x02
+	TrackName      = 0x03
+	InstrumentName = 0x04
+	Lyric          = 0x05
+	Marker         = 0x06
+	CuePoint       = 0x07
+	SMPTEOffset    = 0x54
+	TimeSignature  = 0x58
+	KeySignature   = 0x59
 )
 
 var MessageTypeToString = map[int]string{
@@ -27,6 +69,18 @@ var MessageTypeToString = map[int]string{
 	ChannelPressure: "ChannelPressure",
 	PitchBend:       "PitchBend",
 	SetTempo:        "SetTempo",
+	SysEx:           "SysEx",
+	SysExEscape:     "SysExEscape",
+	Text:            "Text",
+	Copyright:       "Copyright",
+	TrackName:       "TrackName",
+	InstrumentName:  "InstrumentName",
+	Lyric:           "Lyric",
+	Marker:          "Marker",
+	CuePoint:        "CuePoint",
+	SMPTEOffset:     "SMPTEOffset",
+	TimeSignature:   "TimeSignature",
+	KeySignature:    "KeySignature",
 }
 
 var ControlChangeToString = map[int]string{
@@ -179,31 +233,237 @@ const (
 	PolyOn             = 0x7F
 )
 
+// A MidiFile owns the messages of a loaded MIDI file
+// Close frees them; files which become unreachable without being closed
+// (including through all of their Message views) are freed by the garbage
+// collector as a safety net.
+type MidiFile struct {
+	first  *C.tml_message
+	header C.struct_tml_header
+}
+
+func newMidiFile(first *C.tml_message, header *C.struct_tml_header) *MidiFile {
+	if first == nil {
+		return nil
+	}
+	f := &MidiFile{first: first}
+	if header != nil {
+		f.header = *header
+	}
+	runtime.SetFinalizer(f, (*MidiFile).free)
+	return f
+}
+
+func (f *MidiFile) free() {
+	C.tml_free(f.first)
+	f.first = nil
+}
+
+// Returns the first message of the file
+// Messages must not be used after the file was closed.
+func (f *MidiFile) Messages() Message {
+	if f == nil {
+		return Message{}
+	}
+	return Message{f.first, f}
+}
+
+// Copy the messages of the file into a Song, which does not depend on the file
+func (f *MidiFile) Song() *Song {
+	if f == nil {
+		return nil
+	}
+	defer runtime.KeepAlive(f)
+	count := 0
+	for m := f.first; m != nil; m = m.next {
+		count++
+	}
+	song := &Song{Format: int(f.header.format), Division: int(f.header.division), TicksPerFrame: int(f.header.ticks_per_frame), Events: make(Events, 0, count)}
+	if f.header.smpte_format != 0 {
+		song.FrameRate = smpteFrameRate(int(f.header.smpte_format))
+	}
+	for m := f.first; m != nil; m = m.next {
+		song.Events = append(song.Events, newEvent(m))
+	}
+	if song.Format == 2 {
+		song.splitSequences()
+	} else {
+		song.computeSeconds()
+	}
+	return song
+}
+
+func newEvent(m *C.tml_message) Event {
+	e := Event{Time: int(m.time), Tick: int(m.tick), Track: int(m.track), Type: int(m._type)}
+	data := m.anon0
+	switch e.Type {
+	case SetTempo:
+		e.Data1 = int(C.tml_get_tempo_value(m))
+	case PitchBend:
+		e.Channel = int(m.channel)
+		e.Data1 = int(uint8(data[0])) | int(uint8(data[1]))<<8
+	case Text, Copyright, TrackName, InstrumentName, Lyric, Marker, CuePoint, SMPTEOffset, SysEx, SysExEscape:
+		e.Payload = C.GoBytes(unsafe.Pointer(m.data), C.int(m.data_length))
+	case TimeSignature:
+		e.Payload = C.GoBytes(unsafe.Pointer(m.data), C.int(m.data_length))
+		e.Data1 = int(e.Payload[0])
+		e.Data2 = 1 << (e.Payload[1] & 15)
+	case KeySignature:
+		e.Payload = C.GoBytes(unsafe.Pointer(m.data), C.int(m.data_length))
+		e.Data1 = int(int8(e.Payload[0]))
+		e.Data2 = int(e.Payload[1])
+	default:
+		e.Channel = int(m.channel)
+		e.Data1 = int(uint8(data[0]))
+		e.Data2 = int(uint8(data[1]))
+	}
+	return e
+}
+
+// Free the messages of the file
+func (f *MidiFile) Close() {
+	if f == nil || f.first == nil {
+		return
+	}
+	runtime.SetFinalizer(f, nil)
+	f.free()
+}
+
+// A view of a single message of a MidiFile, which is linked to the next message in time
 type Message struct {
 	message *C.tml_message
+	file    *MidiFile
 }
 
-func (m Message) Time() int            { return int(m.message.time) }
-func (m Message) Type() int            { return int(m.message._type) }
-func (m Message) Channel() int         { return int(m.message.channel) }
-func (m Message) Key() int             { return int(m.message.anon0[0]) }
-func (m Message) Control() int         { return int(m.message.anon0[0]) }
-func (m Message) Program() int         { return int(m.message.anon0[0]) }
-func (m Message) ChannelPressure() int { return int(m.message.anon0[0]) }
-func (m Message) Velocity() int        { return int(m.message.anon0[1]) }
-func (m Message) KeyPressure() int     { return int(m.message.anon0[1]) }
-func (m Message) ControlValue() int    { return int(m.message.anon0[1]) }
+// Copy the message out of C memory, keeping the file alive while doing so
+func (m Message) get() C.tml_message {
+	defer runtime.KeepAlive(m.file)
+	return *m.message
+}
+
+func (m Message) Time() int            { return int(m.get().time) }
+func (m Message) Tick() int            { return int(m.get().tick) }
+func (m Message) Track() int           { return int(m.get().track) }
+func (m Message) Type() int            { return int(m.get()._type) }
+func (m Message) Channel() int         { return int(m.get().channel) }
+func (m Message) Key() int             { return int(m.get().anon0[0]) }
+func (m Message) Control() int         { return int(m.get().anon0[0]) }
+func (m Message) Program() int         { return int(m.get().anon0[0]) }
+func (m Message) ChannelPressure() int { return int(m.get().anon0[0]) }
+func (m Message) Velocity() int        { return int(m.get().anon0[1]) }
+func (m Message) KeyPressure() int     { return int(m.get().anon0[1]) }
+func (m Message) ControlValue() int    { return int(m.get().anon0[1]) }
 func (m Message) PitchBend() int {
-	return (int(m.message.anon0[0]) << 8) | int(m.message.anon0[1])
+	data := m.get().anon0
+	return int(uint8(data[0])) | int(uint8(data[1]))<<8
 }
-func (m Message) HasNext() bool { return m.message.next != nil }
-func (m Message) Next() Message { return Message{m.message.next} }
+func (m Message) HasNext() bool { return m.get().next != nil }
+func (m Message) Next() Message { return Message{m.get().next, m.file} }
 func (m Message) IsNil() bool   { return m.message == nil }
 
+// Returns the text of a meta message
+func (m Message) Text() string {
+	defer runtime.KeepAlive(m.file)
+	return C.GoStringN((*C.char)(unsafe.Pointer(m.message.data)), C.int(m.message.data_length))
+}
+
+// Returns a copy of the payload of a meta or system exclusive message
+func (m Message) Data() []byte {
+	defer runtime.KeepAlive(m.file)
+	return C.GoBytes(unsafe.Pointer(m.message.data), C.int(m.message.data_length))
+}
+
+// Copy the message into an Event
+// The exact time (Seconds) is only known to a Song and left at 0.
+func (m Message) Event() Event {
+	defer runtime.KeepAlive(m.file)
+	return newEvent(m.message)
+}
+
+// Directly load a MIDI file from a .mid file path
+// The returned messages are freed once they are no longer referenced.
 func LoadMidiFile(filename string) Message {
-	return Message{C.tml_load_filename(C.CString(filename))}
+	name := C.CString(filename)
+	defer C.free(unsafe.Pointer(name))
+	return newMidiFile(C.tml_load_filename(name), nil).Messages()
 }
 
+// Load a MIDI file from a block of memory
+// The returned messages are freed once they are no longer referenced.
 func LoadMidiMemory(mem []byte) Message {
-	return Message{C.tml_load_memory(C.CBytes(mem), C.int(len(mem)))}
+	return newMidiFile(C.tml_load_memory(bytesPointer(mem), C.int(len(mem))), nil).Messages()
+}
+
+// Load a MIDI file from a .mid file path, reporting why loading failed
+// If the file is damaged but events could be read up to that point, the
+// song is returned together with the error describing the damage.
+func ReadMidiFile(filename string) (*Song, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadMidi(file)
+}
+
+// Load a MIDI file from a stream, reporting why loading failed
+// Errors returned by r take precedence over errors about the MIDI data.
+func LoadMidi(r io.Reader) (*Song, error) {
+	f, err := OpenMidi(r)
+	defer f.Close()
+	return f.Song(), err
+}
+
+// Load a MIDI file from a block of memory, reporting why loading failed
+// The memory is not retained and can be reused once this returns.
+func ReadMidiMemory(mem []byte) (*Song, error) {
+	var h C.struct_tml_header
+	var e C.struct_tml_error
+	f := newMidiFile(C.tml_load_memory_ex(bytesPointer(mem), C.int(len(mem)), &h, &e), &h)
+	defer f.Close()
+	return f.Song(), midiError(f, &e)
+}
+
+// Load the messages of a MIDI file from a stream without copying them into a Song
+func OpenMidi(r io.Reader) (*MidiFile, error) {
+	var h C.struct_tml_header
+	var e C.struct_tml_error
+	handle, stream := registerStream(r)
+	defer unregisterStream(handle)
+	f := newMidiFile(C.tml_load_go_stream(C.uintptr_t(handle), &h, &e), &h)
+	if stream.err != nil {
+		return f, stream.err
+	}
+	return f, midiError(f, &e)
+}
+
+func midiError(f *MidiFile, e *C.struct_tml_error) error {
+	if e.message == nil {
+		if f == nil {
+			return &LoadError{Err: ErrNoMessages, Track: -1, Offset: -1}
+		}
+		return nil
+	}
+	var err error
+	switch e.code {
+	case C.TML_INVALID_NOMIDIHEADER:
+		err = ErrNotMidi
+	case C.TML_INVALID_EOF:
+		err = ErrTruncated
+	case C.TML_INVALID_MTRKHEADER:
+		err = ErrInvalidTrack
+	case C.TML_INVALID_TRACKLENGTH:
+		err = ErrTrackLength
+	case C.TML_INVALID_RUNNINGSTATUS:
+		err = ErrRunningStatus
+	case C.TML_INVALID_VARIABLELENGTH:
+		err = ErrVariableLength
+	case C.TML_INVALID_METALENGTH:
+		err = ErrInvalidMeta
+	case C.TML_OUT_OF_MEMORY:
+		err = ErrOutOfMemory
+	default:
+		err = errors.New("tml: " + C.GoString(e.message))
+	}
+	return &LoadError{Err: err, Track: int(e.track), Offset: int(e.offset)}
 }
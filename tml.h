@@ -94,6 +94,19 @@ typedef struct tml_message
 
 	// The pointer to the next message in time following this event
 	struct tml_message* next;
+
+	// Time of the message in ticks since the start of the file
+	unsigned int tick;
+
+	// Index of the MTrk track the message was read from
+	int track;
+
+	// Payload of meta messages (the text of TML_TEXT to TML_CUE_POINT, not zero terminated,
+	// or the raw bytes of TML_SMPTE_OFFSET, TML_TIME_SIGNATURE and TML_KEY_SIGNATURE)
+	// and of system exclusive messages (TML_SYSEX without the 0xF0 status byte, or TML_EOX)
+	// It is part of the memory block of the message list and freed with it.
+	const unsigned char* data;
+	unsigned int data_length;
 } tml_message;
 
 // The load functions will return a pointer to a struct tml_message.
@@ -139,6 +152,67 @@ struct tml_stream
 // Generic Midi loading method using the stream structure above
 TMLDEF tml_message* tml_load(struct tml_stream* stream);
 
+// Information from the MThd header of the file
+struct tml_header
+{
+	// File format (0 = single track, 1 = simultaneous tracks, 2 = independent sequences)
+	int format;
+
+	// Number of MTrk tracks
+	int num_tracks;
+
+	// Number of ticks per beat (quarter-note), or 0 if the file uses SMPTE timing
+	int division;
+
+	// SMPTE frames per second (24, 25, 29 for 29.97 drop-frame or 30) and ticks per frame, or 0
+	int smpte_format, ticks_per_frame;
+};
+
+// Reasons why loading a MIDI file failed (or only partially succeeded)
+enum TMLError
+{
+	// No error
+	TML_NO_ERROR,
+	// Stream does not start with a valid MThd header or timing information
+	TML_INVALID_NOMIDIHEADER,
+	// The stream ended in the middle of a header or track
+	TML_INVALID_EOF,
+	// A track does not start with an MTrk header
+	TML_INVALID_MTRKHEADER,
+	// The events of a track did not end where its header said
+	TML_INVALID_TRACKLENGTH,
+	// An event has no status byte and there is no running status to use
+	TML_INVALID_RUNNINGSTATUS,
+	// A variable length quantity is longer than 4 bytes
+	TML_INVALID_VARIABLELENGTH,
+	// A meta event has a length not matching its type
+	TML_INVALID_METALENGTH,
+	// Memory allocation failed
+	TML_OUT_OF_MEMORY,
+};
+
+// Description of the first problem encountered while loading
+struct tml_error
+{
+	// Reason of the error or warning (TML_NO_ERROR if there was no problem)
+	enum TMLError code;
+
+	// Message text of the error or warning (NULL if there was no problem)
+	const char* message;
+
+	// Index of the MTrk track the problem was found in (-1 for the file header)
+	int track;
+
+	// Byte offset in the stream where the problem was detected
+	unsigned int offset;
+};
+
+// Generic Midi loading method which also returns the file header and reports why loading failed
+// If messages could be read before a problem was encountered, they are
+// returned and error describes the damaged part of the file.
+// NULL can be passed for header or error if not needed.
+TMLDEF tml_message* tml_load_ex(struct tml_stream* stream, struct tml_header* header, struct tml_error* error);
+
 // If this library is used together with TinySoundFont, tsf_stream (equivalent to tml_stream) can also be used
 struct tsf_stream;
 TMLDEF tml_message* tml_load_tsf_stream(struct tsf_stream* stream);
@@ -236,8 +310,12 @@ struct tml_tempomsg
 
 struct tml_parser
 {
-	unsigned char *buf, *buf_end;
-	int last_status, message_array_size, message_count;
+	unsigned char *buf, *buf_start, *buf_end;
+	int last_status, message_array_size, message_count, track;
+	unsigned int buf_offset;
+	struct tml_error* error;
+	unsigned char* data;
+	unsigned int data_size, data_capacity;
 };
 
 enum TMLSystemType
@@ -248,6 +326,18 @@ enum TMLSystemType
 	TML_TICK  = 0xf9, TML_START        = 0xfa, TML_CONTINUE       = 0xfb, TML_STOP          = 0xfc, TML_ACTIVE_SENSING  = 0xfe, TML_SYSTEM_RESET = 0xff
 };
 
+static void tml_report(struct tml_parser* p, enum TMLError code, const char* msg, int is_error)
+{
+	if (p->error && !p->error->message)
+	{
+		p->error->code = code;
+		p->error->message = msg;
+		p->error->track = p->track;
+		p->error->offset = p->buf_offset + (unsigned int)(p->buf - p->buf_start);
+	}
+	if (is_error) { TML_ERROR(msg) } else { TML_WARN(msg) }
+}
+
 static int tml_readbyte(struct tml_parser* p)
 {
 	return (p->buf == p->buf_end ? -1 : *(p->buf++));
@@ -259,12 +349,32 @@ static int tml_readvariablelength(struct tml_parser* p)
 	unsigned char c;
 	for (; i != 4; i++)
 	{
-		if (p->buf == p->buf_end) { TML_WARN("Unexpected end of file"); return -1; }
+		if (p->buf == p->buf_end) { tml_report(p, TML_INVALID_EOF, "Unexpected end of file", 0); return -1; }
 		c = *(p->buf++);
 		if (c & 0x80) res = ((res | (c & 0x7F)) << 7);
 		else return (int)(res | c);
 	}
-	TML_WARN("Invalid variable length byte count"); return -1;
+	tml_report(p, TML_INVALID_VARIABLELENGTH, "Invalid variable length byte count", 0); return -1;
+}
+
+// Collect the payload of a message in the data block which gets appended to the message array once parsing is done
+// Until then the data pointer of the message holds the offset into the data block.
+static int tml_storedata(tml_message* evt, struct tml_parser* p, const unsigned char* data, int length)
+{
+	if (p->data_size + length > p->data_capacity)
+	{
+		unsigned char* grown;
+		p->data_capacity = (p->data_capacity ? p->data_capacity * 2 : 1024);
+		if (p->data_capacity < p->data_size + length) p->data_capacity = p->data_size + length;
+		grown = (unsigned char*)TML_REALLOC(p->data, p->data_capacity);
+		if (!grown) { tml_report(p, TML_OUT_OF_MEMORY, "Out of memory", 1); return 0; }
+		p->data = grown;
+	}
+	if (length) TML_MEMCPY(p->data + p->data_size, data, length);
+	evt->data = (const unsigned char*)(size_t)p->data_size;
+	evt->data_length = length;
+	p->data_size += length;
+	return 1;
 }
 
 static int tml_parsemessage(tml_message** f, struct tml_parser* p)
@@ -273,11 +383,11 @@ static int tml_parsemessage(tml_message** f, struct tml_parser* p)
 	tml_message* evt;
 
 	if (deltatime & 0xFFF00000) deltatime = 0; //throw away delays that are insanely high for malformatted midis
-	if (status < 0) { TML_WARN("Unexpected end of file"); return -1; }
+	if (status < 0) { tml_report(p, TML_INVALID_EOF, "Unexpected end of file", 0); return -1; }
 	if ((status & 0x80) == 0)
 	{
 		// Invalid, use same status as before
-		if ((p->last_status & 0x80) == 0) { TML_WARN("Undefined status and invalid running status"); return -1; }
+		if ((p->last_status & 0x80) == 0) { tml_report(p, TML_INVALID_RUNNINGSTATUS, "Undefined status and invalid running status", 0); return -1; }
 		p->buf--;
 		status = p->last_status;
 	}
@@ -288,41 +398,62 @@ static int tml_parsemessage(tml_message** f, struct tml_parser* p)
 		//start allocated memory size of message array at 64, double each time until 8192, then add 1024 entries until done
 		p->message_array_size += (!p->message_array_size ? 64 : (p->message_array_size > 4096 ? 1024 : p->message_array_size));
 		*f = (tml_message*)TML_REALLOC(*f, p->message_array_size * sizeof(tml_message));
-		if (!*f) { TML_ERROR("Out of memory"); return -1; }
+		if (!*f) { tml_report(p, TML_OUT_OF_MEMORY, "Out of memory", 1); return -1; }
 	}
 	evt = *f + p->message_count;
+	evt->channel = 0;
+	evt->pitch_bend = 0;
+	evt->track = p->track;
+	evt->data = TML_NULL;
+	evt->data_length = 0;
 
 	//check what message we have
 	if ((status == TML_SYSEX) || (status == TML_EOX)) //sysex
 	{
-		//sysex messages are not handled
-		p->buf += tml_readvariablelength(p);
-		if (p->buf > p->buf_end) { TML_WARN("Unexpected end of file"); p->buf = p->buf_end; return -1; }
-		evt->type = 0;
+		int buflen = tml_readvariablelength(p);
+		unsigned char* sysexdata = p->buf;
+		if (buflen < 0) return -1;
+		if ((p->buf += buflen) > p->buf_end) { tml_report(p, TML_INVALID_EOF, "Unexpected end of file", 0); p->buf = p->buf_end; return -1; }
+		if (!tml_storedata(evt, p, sysexdata, buflen)) return -1;
+		evt->type = (unsigned char)status;
 	}
 	else if (status == 0xFF) //meta events
 	{
 		int meta_type = tml_readbyte(p), buflen = tml_readvariablelength(p);
 		unsigned char* metadata = p->buf;
-		if (meta_type < 0) { TML_WARN("Unexpected end of file"); return -1; }
-		if (buflen > 0 && (p->buf += buflen) > p->buf_end) { TML_WARN("Unexpected end of file"); p->buf = p->buf_end; return -1; }
+		if (meta_type < 0) { tml_report(p, TML_INVALID_EOF, "Unexpected end of file", 0); return -1; }
+		if (buflen > 0 && (p->buf += buflen) > p->buf_end) { tml_report(p, TML_INVALID_EOF, "Unexpected end of file", 0); p->buf = p->buf_end; return -1; }
 
 		switch (meta_type)
 		{
 			case TML_EOT:
-				if (buflen != 0) { TML_WARN("Invalid length for EndOfTrack event"); return -1; }
+				if (buflen != 0) { tml_report(p, TML_INVALID_METALENGTH, "Invalid length for EndOfTrack event", 0); return -1; }
 				if (!deltatime) return TML_EOT; //no need to store this message
 				evt->type = TML_EOT;
 				break;
 
 			case TML_SET_TEMPO:
-				if (buflen != 3) { TML_WARN("Invalid length for SetTempo meta event"); return -1; }
+				if (buflen != 3) { tml_report(p, TML_INVALID_METALENGTH, "Invalid length for SetTempo meta event", 0); return -1; }
 				evt->type = TML_SET_TEMPO;
 				((struct tml_tempomsg*)evt)->Tempo[0] = metadata[0];
 				((struct tml_tempomsg*)evt)->Tempo[1] = metadata[1];
 				((struct tml_tempomsg*)evt)->Tempo[2] = metadata[2];
 				break;
 
+			case TML_TEXT: case TML_COPYRIGHT: case TML_TRACK_NAME: case TML_INST_NAME: case TML_LYRIC: case TML_MARKER: case TML_CUE_POINT:
+				if (buflen < 0) buflen = 0;
+				if (!tml_storedata(evt, p, metadata, buflen)) return -1;
+				evt->type = (unsigned char)meta_type;
+				break;
+
+			case TML_SMPTE_OFFSET:
+			case TML_TIME_SIGNATURE:
+			case TML_KEY_SIGNATURE:
+				if (buflen < (meta_type == TML_SMPTE_OFFSET ? 5 : meta_type == TML_TIME_SIGNATURE ? 4 : 2)) { evt->type = 0; break; } //ignore malformed events
+				if (!tml_storedata(evt, p, metadata, buflen)) return -1;
+				evt->type = (unsigned char)meta_type;
+				break;
+
 			default:
 				evt->type = 0;
 		}
@@ -330,7 +461,7 @@ static int tml_parsemessage(tml_message** f, struct tml_parser* p)
 	else //channel message
 	{
 		int param;
-		if ((param = tml_readbyte(p)) < 0) { TML_WARN("Unexpected end of file"); return -1; }
+		if ((param = tml_readbyte(p)) < 0) { tml_report(p, TML_INVALID_EOF, "Unexpected end of file", 0); return -1; }
 		evt->key = (param & 0x7f);
 		evt->channel = (status & 0x0f);
 		switch (evt->type = (status & 0xf0))
@@ -339,12 +470,12 @@ static int tml_parsemessage(tml_message** f, struct tml_parser* p)
 			case TML_NOTE_ON:
 			case TML_KEY_PRESSURE:
 			case TML_CONTROL_CHANGE:
-				if ((param = tml_readbyte(p)) < 0) { TML_WARN("Unexpected end of file"); return -1; }
+				if ((param = tml_readbyte(p)) < 0) { tml_report(p, TML_INVALID_EOF, "Unexpected end of file", 0); return -1; }
 				evt->velocity = (param & 0x7f);
 				break;
 
 			case TML_PITCH_BEND:
-				if ((param = tml_readbyte(p)) < 0) { TML_WARN("Unexpected end of file"); return -1; }
+				if ((param = tml_readbyte(p)) < 0) { tml_report(p, TML_INVALID_EOF, "Unexpected end of file", 0); return -1; }
 				evt->pitch_bend = ((param & 0x7f) << 7) | evt->key;
 				break;
 
@@ -369,20 +500,45 @@ static int tml_parsemessage(tml_message** f, struct tml_parser* p)
 
 TMLDEF tml_message* tml_load(struct tml_stream* stream)
 {
-	int num_tracks, division, trackbufsize = 0;
+	return tml_load_ex(stream, TML_NULL, TML_NULL);
+}
+
+TMLDEF tml_message* tml_load_ex(struct tml_stream* stream, struct tml_header* header, struct tml_error* error)
+{
+	int num_tracks, division, smpte_format = 0, ticks_per_frame = 0, trackbufsize = 0;
 	unsigned char midi_header[14], *trackbuf = TML_NULL;
 	struct tml_message* messages = TML_NULL;
 	struct tml_track *tracks, *t, *tracksEnd;
-	struct tml_parser p = { TML_NULL, TML_NULL, 0, 0, 0 };
+	struct tml_parser p = { TML_NULL, TML_NULL, TML_NULL, 0, 0, 0, -1, 0, TML_NULL, TML_NULL, 0, 0 };
+
+	if (error) { error->code = TML_NO_ERROR; error->message = TML_NULL; error->track = -1; error->offset = 0; }
+	p.error = error;
 
 	// Parse MIDI header
-	if (stream->read(stream->data, midi_header, 14) != 14) { TML_ERROR("Unexpected end of file"); return messages; }
+	if (stream->read(stream->data, midi_header, 14) != 14) { tml_report(&p, TML_INVALID_EOF, "Unexpected end of file", 1); return messages; }
 	if (midi_header[0] != 'M' || midi_header[1] != 'T' || midi_header[2] != 'h' || midi_header[3] != 'd' ||
-	    midi_header[7] != 6   || midi_header[9] >  2) { TML_ERROR("Doesn't look like a MIDI file: invalid MThd header"); return messages; }
-	if (midi_header[12] & 0x80) { TML_ERROR("File uses unsupported SMPTE timing"); return messages; }
+	    midi_header[7] != 6   || midi_header[9] >  2) { tml_report(&p, TML_INVALID_NOMIDIHEADER, "Doesn't look like a MIDI file: invalid MThd header", 1); return messages; }
 	num_tracks = (int)(midi_header[10] << 8) | midi_header[11];
-	division = (int)(midi_header[12] << 8) | midi_header[13]; //division is ticks per beat (quarter-note)
-	if (num_tracks <= 0 && division <= 0) { TML_ERROR("Doesn't look like a MIDI file: invalid track or division values"); return messages; }
+	if (midi_header[12] & 0x80)
+	{
+		//SMPTE timing stores the negative frames per second and the ticks per frame
+		smpte_format = 256 - midi_header[12];
+		ticks_per_frame = midi_header[13];
+		division = 0;
+		if (smpte_format != 24 && smpte_format != 25 && smpte_format != 29 && smpte_format != 30) { p.buf_offset = 12; tml_report(&p, TML_INVALID_NOMIDIHEADER, "Invalid SMPTE frames per second", 1); return messages; }
+		if (ticks_per_frame == 0) { p.buf_offset = 13; tml_report(&p, TML_INVALID_NOMIDIHEADER, "Invalid SMPTE ticks per frame", 1); return messages; }
+	}
+	else division = (int)(midi_header[12] << 8) | midi_header[13]; //division is ticks per beat (quarter-note)
+	if (num_tracks <= 0 && division <= 0 && !smpte_format) { p.buf_offset = 10; tml_report(&p, TML_INVALID_NOMIDIHEADER, "Doesn't look like a MIDI file: invalid track or division values", 1); return messages; }
+	if (header)
+	{
+		header->format = midi_header[9];
+		header->num_tracks = num_tracks;
+		header->division = division;
+		header->smpte_format = smpte_format;
+		header->ticks_per_frame = ticks_per_frame;
+	}
+	p.buf_offset = 14;
 
 	// Allocate temporary tracks array for parsing
 	tracks = (struct tml_track*)TML_MALLOC(sizeof(struct tml_track) * num_tracks);
@@ -394,34 +550,58 @@ TMLDEF tml_message* tml_load(struct tml_stream* stream)
 	{
 		unsigned char track_header[8];
 		int track_length;
-		if (stream->read(stream->data, track_header, 8) != 8) { TML_WARN("Unexpected end of file"); break; }
+		p.track = (int)(t - tracks);
+		p.buf = p.buf_start = TML_NULL;
+		if (stream->read(stream->data, track_header, 8) != 8) { tml_report(&p, TML_INVALID_EOF, "Unexpected end of file", 0); break; }
 		if (track_header[0] != 'M' || track_header[1] != 'T' || track_header[2] != 'r' || track_header[3] != 'k')
-			{ TML_WARN("Invalid MTrk header"); break; }
+			{ tml_report(&p, TML_INVALID_MTRKHEADER, "Invalid MTrk header", 0); break; }
 
 		// Get size of track data and read into buffer (allocate bigger buffer if needed)
 		track_length = track_header[7] | (track_header[6] << 8) | (track_header[5] << 16) | (track_header[4] << 24);
-		if (track_length < 0) { TML_WARN("Invalid MTrk header"); break; }
+		if (track_length < 0) { tml_report(&p, TML_INVALID_MTRKHEADER, "Invalid MTrk header", 0); break; }
+		p.buf_offset += 8;
 		if (trackbufsize < track_length) { TML_FREE(trackbuf); trackbuf = (unsigned char*)TML_MALLOC(trackbufsize = track_length); }
-		if (stream->read(stream->data, trackbuf, track_length) != track_length) { TML_WARN("Unexpected end of file"); break; }
+		if (stream->read(stream->data, trackbuf, track_length) != track_length) { tml_report(&p, TML_INVALID_EOF, "Unexpected end of file", 0); break; }
 
 		t->Idx = p.message_count;
-		for (p.buf_end = (p.buf = trackbuf) + track_length; p.buf != p.buf_end;)
+		for (p.buf_end = (p.buf = p.buf_start = trackbuf) + track_length; p.buf != p.buf_end;)
 		{
 			int type = tml_parsemessage(&messages, &p);
 			if (type == TML_EOT || type < 0) break; //file end or illegal data encountered
 		}
-		if (p.buf != p.buf_end) { TML_WARN( "Track length did not match data length"); }
+		if (p.buf != p.buf_end) { tml_report(&p, TML_INVALID_TRACKLENGTH, "Track length did not match data length", 0); }
 		t->End = p.message_count;
+		p.buf_offset += track_length;
 	}
 	TML_FREE(trackbuf);
 
+	// Append the collected payloads to the message array so the list stays a single allocation
+	if (p.message_count && p.data_size)
+	{
+		tml_message *Msg, *MsgEnd;
+		unsigned char* data;
+		struct tml_message* grown = (tml_message*)TML_REALLOC(messages, p.message_count * sizeof(tml_message) + p.data_size);
+		if (!grown) { tml_report(&p, TML_OUT_OF_MEMORY, "Out of memory", 1); TML_FREE(p.data); TML_FREE(tracks); TML_FREE(messages); return TML_NULL; }
+		messages = grown;
+		data = (unsigned char*)(messages + p.message_count);
+		TML_MEMCPY(data, p.data, p.data_size);
+		for (Msg = messages, MsgEnd = messages + p.message_count; Msg != MsgEnd; Msg++)
+			if (Msg->data_length) Msg->data = data + (size_t)Msg->data;
+			else Msg->data = TML_NULL;
+	}
+	TML_FREE(p.data);
+
 	// Change message time signature from delta ticks to actual msec values and link messages ordered by time
 	if (p.message_count)
 	{
 		tml_message *PrevMessage = TML_NULL, *Msg, *MsgEnd, Swap;
 		unsigned int ticks = 0, tempo_ticks = 0; //tick counter and value at last tempo change
 		int step_smallest, msec, tempo_msec = 0; //msec value at last tempo change
-		double ticks2time = 500000 / (1000.0 * division); //milliseconds per tick
+		double ticks2time; //milliseconds per tick
+
+		//SMPTE ticks have a fixed length, tempo changes don't affect them
+		if (smpte_format) ticks2time = 1000.0 / ((smpte_format == 29 ? 30000.0 / 1001 : smpte_format) * ticks_per_frame);
+		else ticks2time = 500000 / (1000.0 * division);
 
 		// Loop through all messages over all tracks ordered by time
 		for (step_smallest = 0; step_smallest != 0x7fffffff; ticks += step_smallest)
@@ -434,7 +614,7 @@ TMLDEF tml_message* tml_load(struct tml_stream* stream)
 				for (Msg = &messages[t->Idx], MsgEnd = &messages[t->End]; Msg != MsgEnd && t->Ticks + Msg->time == ticks; Msg++, t->Idx++)
 				{
 					t->Ticks += Msg->time;
-					if (Msg->type == TML_SET_TEMPO)
+					if (Msg->type == TML_SET_TEMPO && !smpte_format)
 					{
 						unsigned char* Tempo = ((struct tml_tempomsg*)Msg)->Tempo;
 						ticks2time = ((Tempo[0]<<16)|(Tempo[1]<<8)|Tempo[2])/(1000.0 * division);
@@ -444,6 +624,7 @@ TMLDEF tml_message* tml_load(struct tml_stream* stream)
 					if (Msg->type)
 					{
 						Msg->time = msec;
+						Msg->tick = ticks;
 						if (PrevMessage) { PrevMessage->next = Msg; PrevMessage = Msg; }
 						else { Swap = *Msg; *Msg = *messages; *messages = Swap; PrevMessage = messages; }
 					}
@@ -514,4 +695,4 @@ TMLDEF void tml_free(tml_message* f)
 }
 #endif
 
-#endif //TML_IMPLEMENTATION
\ No newline at end of file
+#endif //TML_IMPLEMENTATION
\ No newline at end of file
@@ -3,9 +3,36 @@ package tsf
 //#cgo LDFLAGS: -lm
 //#define TSF_STATIC 1
 //#define TSF_IMPLEMENTATION 1
+//#include <stdint.h>
+//#include <stdlib.h>
 //#include "tsf.h"
+//
+//static tsf* tsf_load_memory_ex(const void* buffer, int size, enum TSFError* error)
+//{
+//	struct tsf_stream stream = { TSF_NULL, (int(*)(void*,void*,unsigned int))&tsf_stream_memory_read, (int(*)(void*,unsigned int))&tsf_stream_memory_skip };
+//	struct tsf_stream_memory f = { (const char*)buffer, (unsigned int)size, 0 };
+//	stream.data = &f;
+//	return tsf_load_ex(&stream, error);
+//}
+//
+//extern int goStreamRead(void* data, void* ptr, unsigned int size);
+//extern int goStreamSkip(void* data, unsigned int count);
+//
+//static tsf* tsf_load_go_stream(uintptr_t handle, enum TSFError* error)
+//{
+//	struct tsf_stream stream = { (void*)handle, &goStreamRead, &goStreamSkip };
+//	return tsf_load_ex(&stream, error);
+//}
 import "C"
 
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
 // The lower this block size is the more accurate the effects are.
 // Increasing the value significantly lowers the CPU usage of the voice rendering.
 // If LFO affects the low-pass filter it can be hearable even as low as 8.
@@ -24,51 +51,167 @@ const (
 	OutputModeMono OutputMode = C.TSF_MONO
 )
 
+// A loaded SoundFont and the voices and channels playing it
+// Copies of a SoundFont value refer to the same instance. Close frees it;
+// instances which become unreachable without being closed are freed by
+// the garbage collector as a safety net.
 type SoundFont struct {
+	*fontHandle
+}
+
+// Shared by all copies of a SoundFont so the finalizer only runs once none are left.
+// Methods keep the handle alive until their C call returned.
+type fontHandle struct {
 	font *C.tsf
 }
 
+func newSoundFont(font *C.tsf) SoundFont {
+	if font == nil {
+		return SoundFont{}
+	}
+	h := &fontHandle{font}
+	runtime.SetFinalizer(h, closeFontHandle)
+	return SoundFont{h}
+}
+
+// Guards the reference count of the presets and samples shared by copies
+var copyLock sync.Mutex
+
+func closeFontHandle(h *fontHandle) {
+	copyLock.Lock()
+	defer copyLock.Unlock()
+	C.tsf_close(h.font)
+	h.font = nil
+}
+
 // Directly load a SoundFont from a .sf2 file path
 func LoadSoundFontFile(filename string) SoundFont {
-	return SoundFont{C.tsf_load_filename(C.CString(filename))}
+	name := C.CString(filename)
+	defer C.free(unsafe.Pointer(name))
+	return newSoundFont(C.tsf_load_filename(name))
 }
 
 // Load a SoundFont from a block of memory
 func LoadSoundFontMemory(mem []byte) SoundFont {
-	return SoundFont{C.tsf_load_memory(C.CBytes(mem), C.int(len(mem)))}
+	return newSoundFont(C.tsf_load_memory(bytesPointer(mem), C.int(len(mem))))
+}
+
+// Load a SoundFont from a .sf2 file path, reporting why loading failed
+func ReadSoundFontFile(filename string) (SoundFont, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return SoundFont{}, err
+	}
+	defer file.Close()
+	return LoadSoundFont(file)
+}
+
+// Load a SoundFont from a stream, reporting why loading failed
+// The data is read in small blocks so it never has to be held in memory as a whole.
+// If r is also an io.Seeker, unused chunks are skipped by seeking. To load from an
+// io.ReaderAt wrap it in an io.SectionReader.
+func LoadSoundFont(r io.Reader) (SoundFont, error) {
+	var e C.enum_TSFError
+	handle, stream := registerStream(r)
+	defer unregisterStream(handle)
+	font := C.tsf_load_go_stream(C.uintptr_t(handle), &e)
+	if stream.err != nil {
+		// sample data is read without checking so the font can't be trusted
+		C.tsf_close(font)
+		return SoundFont{}, stream.err
+	}
+	return newSoundFont(font), soundFontError(font, e)
+}
+
+// Load a SoundFont from a block of memory, reporting why loading failed
+// The memory is not retained and can be reused once this returns.
+func ReadSoundFontMemory(mem []byte) (SoundFont, error) {
+	var e C.enum_TSFError
+	font := C.tsf_load_memory_ex(bytesPointer(mem), C.int(len(mem)), &e)
+	return newSoundFont(font), soundFontError(font, e)
+}
+
+func soundFontError(font *C.tsf, e C.enum_TSFError) error {
+	var err error
+	switch e {
+	case C.TSF_INVALID_NOSF2HEADER:
+		err = ErrNotRIFF
+	case C.TSF_INVALID_INCOMPLETE:
+		err = ErrIncomplete
+	case C.TSF_INVALID_NOSAMPLEDATA:
+		err = ErrNoSampleData
+	default:
+		if font != nil {
+			return nil
+		}
+		err = ErrIncomplete
+	}
+	return &LoadError{Err: err, Track: -1, Offset: -1}
+}
+
+// C may read from Go memory for the duration of a call as long as it holds no Go pointers
+func bytesPointer(mem []byte) unsafe.Pointer {
+	if len(mem) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(&mem[0])
 }
 
 func (f SoundFont) IsNil() bool {
-	return f.font == nil
+	return f.fontHandle == nil || f.font == nil
 }
 
 // Free the memory related to this tsf instance
 func (f SoundFont) Close() {
-	C.tsf_close(f.font)
+	if f.IsNil() {
+		return
+	}
+	runtime.SetFinalizer(f.fontHandle, nil)
+	closeFontHandle(f.fontHandle)
+}
+
+// Create an independent instance which shares the loaded presets and samples
+// The copy has its own voices, channels, output and effect settings, which
+// start out like the ones of f without playing voices or set up channels. The shared
+// data is freed once all instances are closed. Copies may be used on
+// different goroutines than f.
+func (f SoundFont) Copy() SoundFont {
+	if f.IsNil() {
+		return SoundFont{}
+	}
+	defer runtime.KeepAlive(f.fontHandle)
+	copyLock.Lock()
+	defer copyLock.Unlock()
+	return newSoundFont(C.tsf_copy(f.font))
 }
 
 // Stop all playing notes immediatly and reset all channel parameters
 func (f SoundFont) Reset() {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_reset(f.font)
 }
 
 // Returns the preset index from a bank and preset number, or -1 if it does not exist in the loaded SoundFont
 func (f SoundFont) GetPresetIndex(bank, preset int) int {
+	defer runtime.KeepAlive(f.fontHandle)
 	return int(C.tsf_get_presetindex(f.font, C.int(bank), C.int(preset)))
 }
 
 // Returns the number of presets in the loaded SoundFont
 func (f SoundFont) GetPresetCount() int {
+	defer runtime.KeepAlive(f.fontHandle)
 	return int(C.tsf_get_presetcount(f.font))
 }
 
 // Returns the name of a preset index >= 0 and < f.GetPresetCount()
 func (f SoundFont) GetPresetName(preset int) string {
+	defer runtime.KeepAlive(f.fontHandle)
 	return C.GoString(C.tsf_get_presetname(f.font, C.int(preset)))
 }
 
 // Returns the name of a preset by bank and preset number
 func (f SoundFont) BankGetPresetName(bank, preset int) string {
+	defer runtime.KeepAlive(f.fontHandle)
 	return C.GoString(C.tsf_bank_get_presetname(f.font, C.int(bank), C.int(preset)))
 }
 
@@ -84,18 +227,42 @@ func (f SoundFont) BankGetPresetName(bank, preset int) string {
 // There is a theoretical chance that ending notes would negatively influence
 // a voice that is rendering at the time but it is hard to say.
 // Also be aware, this has not been tested much.
+// In Go, a Synth queues the note and channel functions without locking so
+// they can be called from any goroutine while rendering.
 
 // Setup the parameters for the voice render methods
 // mode: if mono or stereo and how stereo channel data is ordered
 // sampleRate: the number of samples per second (output frequency)
 // gain: volume gain in decibels (>0 means higher, <0 means lower)
 func (f SoundFont) SetOutput(mode OutputMode, sampleRate int, gain float32) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_set_output(f.font, uint32(mode), C.int(sampleRate), C.float(gain))
 }
 
+// Returns the output mode set with SetOutput (default: stereo interleaved)
+func (f SoundFont) GetOutputMode() OutputMode {
+	defer runtime.KeepAlive(f.fontHandle)
+	return OutputMode(f.font.outputmode)
+}
+
+// Returns the sample rate set with SetOutput (default: 44100)
+func (f SoundFont) GetSampleRate() int {
+	defer runtime.KeepAlive(f.fontHandle)
+	return int(f.font.outSampleRate)
+}
+
+// Returns the number of samples per frame in the output buffer (1 for mono, otherwise 2)
+func (f SoundFont) GetOutputChannels() int {
+	if f.GetOutputMode() == OutputModeMono {
+		return 1
+	}
+	return 2
+}
+
 // Set the global gain as a volume factor
 // volume: the desired volume where 1.0 is 100%
 func (f SoundFont) SetVolume(volume float32) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_set_volume(f.font, C.float(volume))
 }
 
@@ -104,14 +271,56 @@ func (f SoundFont) SetVolume(volume float32) {
 // so don't keep this number too low or otherwise sounds may not play.
 // max_voices: maximum number to pre-allocate and set the limit to
 func (f SoundFont) SetMaxVoices(max int) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_set_max_voices(f.font, C.int(max))
 }
 
+// Enable or disable the reverb and chorus effects (default: both enabled)
+// Voices are sent to the effects by the ReverbEffectsSend and ChorusEffectsSend
+// generators of their region and the EffectsDepth1 (reverb) and EffectsDepth3
+// (chorus) controllers of their channel. Channels send to the reverb at the
+// General MIDI default level of EffectsDepth1 (40) unless the controller is
+// changed, so disable the effects to get a dry output. Disabled effects take no
+// time to render.
+func (f SoundFont) SetEffects(reverb, chorus bool) {
+	defer runtime.KeepAlive(f.fontHandle)
+	_reverb, _chorus := 0, 0
+	if reverb {
+		_reverb = 1
+	}
+	if chorus {
+		_chorus = 1
+	}
+	C.tsf_set_effects(f.font, C.int(_reverb), C.int(_chorus))
+}
+
+// Set up the reverb effect
+// roomSize: size of the room from 0.0 to 1.0 (default 0.2)
+// damping: damping of high frequencies from 0.0 to 1.0 (default 0.0)
+// width: stereo width from 0.0 (mono) to 1.0 (default 0.5)
+// level: output volume of the effect where 1.0 is 100% (default 0.9)
+func (f SoundFont) SetReverb(roomSize, damping, width, level float32) {
+	defer runtime.KeepAlive(f.fontHandle)
+	C.tsf_set_reverb(f.font, C.float(roomSize), C.float(damping), C.float(width), C.float(level))
+}
+
+// Set up the chorus effect
+// depth: modulation depth of the delay in milliseconds from 0.0 to 20.0 (default 8.0)
+// rate: modulation frequency in Hz (default 0.3)
+// level: output volume of the effect where 1.0 is 100% (default 1.0)
+func (f SoundFont) SetChorus(depth, rate, level float32) {
+	defer runtime.KeepAlive(f.fontHandle)
+	C.tsf_set_chorus(f.font, C.float(depth), C.float(rate), C.float(level))
+}
+
 // Start playing a note
 // preset: preset index >= 0 and < f.GetPresetCount()
 // key: note value between 0 and 127 (60 being middle C)
 // vel: velocity as a float between 0.0 (equal to note off) and 1.0 (full)
+// The velocity response follows the modulators of the SoundFont, by default the
+// SF2 concave curve makes half velocity about 12dB softer than full velocity.
 func (f SoundFont) NoteOn(preset, key int, velocity float32) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_note_on(f.font, C.int(preset), C.int(key), C.float(velocity))
 }
 
@@ -120,29 +329,36 @@ func (f SoundFont) NoteOn(preset, key int, velocity float32) {
 // preset: preset index >= 0 and < f.GetPresetCount()
 // key: note value between 0 and 127 (60 being middle C)
 // vel: velocity as a float between 0.0 (equal to note off) and 1.0 (full)
+// The velocity response follows the modulators of the SoundFont, by default the
+// SF2 concave curve makes half velocity about 12dB softer than full velocity.
 // returns 0 if preset does not exist, otherwise 1
 func (f SoundFont) BankNoteOn(bank, preset, key int, velocity float32) int {
+	defer runtime.KeepAlive(f.fontHandle)
 	return int(C.tsf_bank_note_on(f.font, C.int(bank), C.int(preset), C.int(key), C.float(velocity)))
 }
 
 // Stop playing a note
 func (f SoundFont) NoteOff(preset, key int) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_note_off(f.font, C.int(preset), C.int(key))
 }
 
 // Stop playing a note
 // returns 0 if preset does not exist, otherwise 1
 func (f SoundFont) BankNoteOff(bank, preset, key int) int {
+	defer runtime.KeepAlive(f.fontHandle)
 	return int(C.tsf_bank_note_off(f.font, C.int(bank), C.int(preset), C.int(key)))
 }
 
 // Stop playing all notes (end with sustain and release)
 func (f SoundFont) NoteOffAll() {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_note_off_all(f.font)
 }
 
 // Returns the number of active voices
 func (f SoundFont) ActiveVoiceCount() int {
+	defer runtime.KeepAlive(f.fontHandle)
 	return int(C.tsf_active_voice_count(f.font))
 }
 
@@ -151,6 +367,7 @@ func (f SoundFont) ActiveVoiceCount() int {
 // samples: number of samples to render
 // mix: if 0 clear the buffer first, otherwise mix into existing data
 func (f SoundFont) RenderShort(dst []int16, samples int, mix bool) {
+	defer runtime.KeepAlive(f.fontHandle)
 	_mix := 0
 	if mix {
 		_mix = 1
@@ -163,6 +380,7 @@ func (f SoundFont) RenderShort(dst []int16, samples int, mix bool) {
 // samples: number of samples to render
 // mix: if 0 clear the buffer first, otherwise mix into existing data
 func (f SoundFont) RenderFloat(dst []float32, samples int, mix bool) {
+	defer runtime.KeepAlive(f.fontHandle)
 	_mix := 0
 	if mix {
 		_mix = 1
@@ -175,12 +393,14 @@ func (f SoundFont) RenderFloat(dst []float32, samples int, mix bool) {
 //
 
 func (f SoundFont) ChannelSetPresetIndex(channel, preset int) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_set_presetindex(f.font, C.int(channel), C.int(preset))
 }
 
 // midiDrums: 0 for normal channels, otherwise apply MIDI drum channel rules
 // returns 0 if preset does not exist, otherwise 1
 func (f SoundFont) ChannelSetPresetNumber(channel, preset int, drums bool) int {
+	defer runtime.KeepAlive(f.fontHandle)
 	_drums := 0
 	if drums {
 		_drums = 1
@@ -189,99 +409,244 @@ func (f SoundFont) ChannelSetPresetNumber(channel, preset int, drums bool) int {
 }
 
 func (f SoundFont) ChannelSetBank(channel, bank int) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_set_bank(f.font, C.int(channel), C.int(bank))
 }
 
 // returns 0 if preset does not exist, otherwise 1
 func (f SoundFont) ChannelSetBankPreset(channel, bank, preset int) int {
+	defer runtime.KeepAlive(f.fontHandle)
 	return int(C.tsf_channel_set_bank_preset(f.font, C.int(channel), C.int(bank), C.int(preset)))
 }
 
 // pan: stereo panning value from 0.0 (left) to 1.0 (right) (default 0.5 center)
 func (f SoundFont) ChannelSetPan(channel int, pan float32) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_set_pan(f.font, C.int(channel), C.float(pan))
 }
 
 // volume: linear volume scale factor (default 1.0 full)
 func (f SoundFont) ChannelSetVolume(channel int, volume float32) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_set_volume(f.font, C.int(channel), C.float(volume))
 }
 
 // pitch: pitch wheel position 0 to 16383 (default 8192 unpitched)
 func (f SoundFont) ChannelSetPitchWheel(channel, pitch int) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_set_pitchwheel(f.font, C.int(channel), C.int(pitch))
 }
 
 // pitch_range: range of the pitch wheel in semitones (default 2.0, total +/- 2 semitones)
 func (f SoundFont) ChannelSetPitchRange(channel int, _range float32) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_set_pitchrange(f.font, C.int(channel), C.float(_range))
 }
 
 // tuning: tuning of all playing voices in semitones (default 0.0, standard (A440) tuning)
 func (f SoundFont) ChannelSetTuning(channel int, tuning float32) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_set_tuning(f.font, C.int(channel), C.float(tuning))
 }
 
 // starts playing note
 // key: note value between 0 and 127 (60 being middle C)
 // vel: velocity as a float between 0.0 (equal to note off) and 1.0 (full)
+// The velocity response follows the modulators of the SoundFont, by default the
+// SF2 concave curve makes half velocity about 12dB softer than full velocity.
 func (f SoundFont) ChannelNoteOn(channel, key int, velocity float32) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_note_on(f.font, C.int(channel), C.int(key), C.float(velocity))
 }
 
 // stops playing note
 // key: note value between 0 and 127 (60 being middle C)
 func (f SoundFont) ChannelNoteOff(channel, key int) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_note_off(f.font, C.int(channel), C.int(key))
 }
 
 // end with sustain and release
 func (f SoundFont) ChannelNoteOffAll(channel int) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_note_off_all(f.font, C.int(channel))
 }
 
 // end immediately
 func (f SoundFont) ChannelSoundsOffAll(channel int) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_sounds_off_all(f.font, C.int(channel))
 }
 
 // Apply a MIDI control change to the channel (not all controllers are supported!)
+// SustainSwitch and SostenutoSwitch hold notes after their note off until the
+// pedal is released, SoftPedalSwitch makes notes started while it's held softer.
+// EffectsDepth1 and EffectsDepth3 set the reverb and chorus send levels (default 40 and 0),
+// so notes get some reverb unless EffectsDepth1 is set to 0 or the effects are disabled with SetEffects.
+// All controllers are also sources of the modulators of the SoundFont, by default
+// ModulationMSB adds vibrato.
 func (f SoundFont) ChannelMidiControl(channel, controller, value int) {
+	defer runtime.KeepAlive(f.fontHandle)
 	C.tsf_channel_midi_control(f.font, C.int(channel), C.int(controller), C.int(value))
 }
 
+// Apply a MIDI channel pressure (aftertouch) to all notes of the channel (pressure from 0 to 127)
+// Pressure is a source of the modulators of the SoundFont, see ChannelSetPressureResponse
+// to let it shape the notes without modulators.
+func (f SoundFont) ChannelPressure(channel, pressure int) {
+	defer runtime.KeepAlive(f.fontHandle)
+	C.tsf_channel_midi_pressure(f.font, C.int(channel), C.int(pressure))
+}
+
+// Apply a MIDI polyphonic key pressure to the notes of a single key of the channel (pressure from 0 to 127)
+func (f SoundFont) ChannelKeyPressure(channel, key, pressure int) {
+	defer runtime.KeepAlive(f.fontHandle)
+	C.tsf_channel_midi_key_pressure(f.font, C.int(channel), C.int(key), C.int(pressure))
+}
+
+// Let ChannelPressure, ChannelKeyPressure and BreathMSB shape the notes of a
+// channel on top of the modulators of the SoundFont, using the strongest of the
+// three (default: all 0, disabled)
+// vibrato: depth of the vibrato at full pressure from 0 to 100 cents
+// filter: opening of the low-pass filter at full pressure from 0 to 4800 cents
+// volume: attenuation of notes without pressure from 0 to 96 dB, at full
+// pressure notes play at their normal volume
+// This is not reset by ChannelMidiControl or MidiSysEx. A Player sets its own
+// response on all channels, see Player.SetChannelPressureResponse.
+func (f SoundFont) ChannelSetPressureResponse(channel int, vibrato, filter, volume float32) {
+	defer runtime.KeepAlive(f.fontHandle)
+	C.tsf_channel_set_pressure_response(f.font, C.int(channel), C.float(vibrato), C.float(filter), C.float(volume))
+}
+
+// Bend the pitch of a single key of the channel
+// Per-note controls only affect the voices playing the key, they can be sent before
+// the note on and are reset to the defaults by its note off and by AllCtrlOff.
+// semitones: pitch bend of the note in semitones (default 0.0)
+func (f SoundFont) ChannelSetNotePitchBend(channel, key int, semitones float32) {
+	defer runtime.KeepAlive(f.fontHandle)
+	C.tsf_channel_set_note_pitchbend(f.font, C.int(channel), C.int(key), C.float(semitones))
+}
+
+// Change the volume of a single key of the channel
+// volume: linear volume scale factor of the note (default 1.0 full)
+func (f SoundFont) ChannelSetNoteVolume(channel, key int, volume float32) {
+	defer runtime.KeepAlive(f.fontHandle)
+	C.tsf_channel_set_note_volume(f.font, C.int(channel), C.int(key), C.float(volume))
+}
+
+// Pan a single key of the channel
+// pan: stereo panning of the note from 0.0 (left) to 1.0 (right), added to the channel pan (default 0.5 center)
+func (f SoundFont) ChannelSetNotePan(channel, key int, pan float32) {
+	defer runtime.KeepAlive(f.fontHandle)
+	C.tsf_channel_set_note_pan(f.font, C.int(channel), C.int(key), C.float(pan))
+}
+
+// Shift the filter cutoff of a single key of the channel
+// cents: shift of the low-pass filter cutoff of the note in cents (default 0.0)
+func (f SoundFont) ChannelSetNoteFilter(channel, key int, cents float32) {
+	defer runtime.KeepAlive(f.fontHandle)
+	C.tsf_channel_set_note_filter(f.font, C.int(channel), C.int(key), C.float(cents))
+}
+
+// Apply a MIDI program change to the channel, using the drum kits of bank 128 on drum channels
+// returns 0 if no matching preset exists, otherwise 1
+func (f SoundFont) ChannelMidiProgram(channel, program int) int {
+	defer runtime.KeepAlive(f.fontHandle)
+	return int(C.tsf_channel_midi_program(f.font, C.int(channel), C.int(program)))
+}
+
+// Set if a channel plays drums (default: only channel 9)
+func (f SoundFont) ChannelSetDrums(channel int, drums bool) {
+	defer runtime.KeepAlive(f.fontHandle)
+	_drums := 0
+	if drums {
+		_drums = 1
+	}
+	C.tsf_channel_set_drums(f.font, C.int(channel), C.int(_drums))
+}
+
+// volume: additional linear volume scale factor for mixing (default 1.0 full)
+// Combines with the MIDI volume and expression controllers instead of being replaced by them.
+func (f SoundFont) ChannelSetMixVolume(channel int, volume float32) {
+	defer runtime.KeepAlive(f.fontHandle)
+	C.tsf_channel_set_mixvolume(f.font, C.int(channel), C.float(volume))
+}
+
+// Bring a channel back into the state a GM System On leaves it in (program,
+// controllers, pitch wheel, tuning and drums) without ending the notes it is playing
+func (f SoundFont) ChannelReset(channel int) {
+	defer runtime.KeepAlive(f.fontHandle)
+	C.tsf_channel_reset(f.font, C.int(channel))
+}
+
+// Apply a MIDI system exclusive message, with or without the 0xF0 status byte
+// Supported are GM System On, GS Reset, XG System On, Master Volume and GS Use For Rhythm Part.
+// returns false if the message was ignored
+func (f SoundFont) MidiSysEx(data []byte) bool {
+	defer runtime.KeepAlive(f.fontHandle)
+	return C.tsf_midi_sysex(f.font, bytesPointer(data), C.int(len(data))) != 0
+}
+
 //
 // boring getters
 //
 
 func (f SoundFont) ChannelGetPresetIndex(channel int) int {
+	defer runtime.KeepAlive(f.fontHandle)
 	return int(C.tsf_channel_get_preset_index(f.font, C.int(channel)))
 }
 
 func (f SoundFont) ChannelGetPresetBank(channel int) int {
+	defer runtime.KeepAlive(f.fontHandle)
 	return int(C.tsf_channel_get_preset_bank(f.font, C.int(channel)))
 }
 
 func (f SoundFont) ChannelGetPresetNumber(channel int) int {
+	defer runtime.KeepAlive(f.fontHandle)
 	return int(C.tsf_channel_get_preset_number(f.font, C.int(channel)))
 }
 
 func (f SoundFont) ChannelGetPan(channel int) float32 {
+	defer runtime.KeepAlive(f.fontHandle)
 	return float32(C.tsf_channel_get_pan(f.font, C.int(channel)))
 }
 
 func (f SoundFont) ChannelGetVolume(channel int) float32 {
+	defer runtime.KeepAlive(f.fontHandle)
 	return float32(C.tsf_channel_get_volume(f.font, C.int(channel)))
 }
 
 func (f SoundFont) ChannelGetPitchWheel(channel int) int {
+	defer runtime.KeepAlive(f.fontHandle)
 	return int(C.tsf_channel_get_pitchwheel(f.font, C.int(channel)))
 }
 
 func (f SoundFont) ChannelGetPitchRange(channel int) float32 {
+	defer runtime.KeepAlive(f.fontHandle)
 	return float32(C.tsf_channel_get_pitchrange(f.font, C.int(channel)))
 }
 
 func (f SoundFont) ChannelGetTuning(channel int) float32 {
+	defer runtime.KeepAlive(f.fontHandle)
 	return float32(C.tsf_channel_get_tuning(f.font, C.int(channel)))
 }
+
+func (f SoundFont) ChannelGetDrums(channel int) bool {
+	defer runtime.KeepAlive(f.fontHandle)
+	return C.tsf_channel_get_drums(f.font, C.int(channel)) != 0
+}
+
+func (f SoundFont) ChannelGetMixVolume(channel int) float32 {
+	defer runtime.KeepAlive(f.fontHandle)
+	return float32(C.tsf_channel_get_mixvolume(f.font, C.int(channel)))
+}
+
+func (f SoundFont) ChannelGetPressure(channel int) int {
+	defer runtime.KeepAlive(f.fontHandle)
+	return int(C.tsf_channel_get_pressure(f.font, C.int(channel)))
+}
+
+func (f SoundFont) ChannelGetKeyPressure(channel, key int) int {
+	defer runtime.KeepAlive(f.fontHandle)
+	return int(C.tsf_channel_get_key_pressure(f.font, C.int(channel), C.int(key)))
+}
@@ -15,9 +15,8 @@
    [OPTIONAL] #define TSF_POW, TSF_POWF, TSF_EXPF, TSF_LOG, TSF_TAN, TSF_LOG10, TSF_SQRT to avoid math.h
 
    NOT YET IMPLEMENTED
-     - Support for ChorusEffectsSend and ReverbEffectsSend generators
      - Better low-pass filter without lowering performance too much
-     - Support for modulators
+     - Linked modulators
 
    LICENSE (MIT)
 
@@ -89,9 +88,32 @@ struct tsf_stream
 // Generic SoundFont loading method using the stream structure above
 TSFDEF tsf* tsf_load(struct tsf_stream* stream);
 
+// Reasons why loading a SoundFont failed
+enum TSFError
+{
+	// No error
+	TSF_NO_ERROR,
+	// Stream does not start with a RIFF header of the form type 'sfbk'
+	TSF_INVALID_NOSF2HEADER,
+	// One of the required preset, instrument or sample header chunks is missing
+	TSF_INVALID_INCOMPLETE,
+	// The sample data chunk is missing
+	TSF_INVALID_NOSAMPLEDATA,
+};
+
+// Generic SoundFont loading method which also reports why loading failed
+TSFDEF tsf* tsf_load_ex(struct tsf_stream* stream, enum TSFError* error);
+
 // Free the memory related to this tsf instance
+// The presets and samples shared with copies are only freed with the last instance.
 TSFDEF void tsf_close(tsf* f);
 
+// Create a new instance sharing the loaded presets and samples of another one
+// The copy has its own voices, channels, output and effect settings, the settings start out
+// like the ones of f. The shared data is reference counted without locking, so tsf_copy and tsf_close of instances
+// sharing it must not be called at the same time.
+TSFDEF tsf* tsf_copy(tsf* f);
+
 // Stop all playing notes immediatly and reset all channel parameters
 TSFDEF void tsf_reset(tsf* f);
 
@@ -147,10 +169,26 @@ TSFDEF void tsf_set_volume(tsf* f, float global_gain);
 //   max_voices: maximum number to pre-allocate and set the limit to
 TSFDEF void tsf_set_max_voices(tsf* f, int max_voices);
 
+// Voices are sent to a reverb and a chorus effect by the ReverbEffectsSend and
+// ChorusEffectsSend generators of their region and the MIDI controllers 91 and 93
+// of their channel. Both effects are enabled by default and channels send 40 of 127 to the reverb
+// unless controller 91 is changed, like General MIDI devices, so notes are no longer rendered dry.
+//   flag_reverb, flag_chorus: 0 to disable the effect for a dry output, which saves the time to render it
+//   room_size: size of the reverb room from 0.0 to 1.0 (default 0.2)
+//   damping: damping of high frequencies from 0.0 to 1.0 (default 0.0)
+//   width: stereo width from 0.0 (mono) to 1.0 (default 0.5)
+//   level: output volume of the effect where 1.0 is 100% (default 0.9 for reverb, 1.0 for chorus)
+//   depth_ms: modulation depth of the chorus delay in milliseconds from 0.0 to 20.0 (default 8.0)
+//   rate_hz: modulation frequency of the chorus in Hz (default 0.3)
+TSFDEF void tsf_set_effects(tsf* f, int flag_reverb, int flag_chorus);
+TSFDEF void tsf_set_reverb(tsf* f, float room_size, float damping, float width, float level);
+TSFDEF void tsf_set_chorus(tsf* f, float depth_ms, float rate_hz, float level);
+
 // Start playing a note
 //   preset_index: preset index >= 0 and < tsf_get_presetcount()
 //   key: note value between 0 and 127 (60 being middle C)
 //   vel: velocity as a float between 0.0 (equal to note off) and 1.0 (full)
+//        (the response follows the modulators of the SoundFont, by default half velocity is about 12dB softer)
 //   bank: instrument bank number (alternative to preset_index)
 //   preset_number: preset number (alternative to preset_index)
 //   (bank_note_on returns 0 if preset does not exist, otherwise 1)
@@ -203,14 +241,66 @@ TSFDEF void tsf_channel_set_tuning(tsf* f, int channel, float tuning);
 //   channel: channel number
 //   key: note value between 0 and 127 (60 being middle C)
 //   vel: velocity as a float between 0.0 (equal to note off) and 1.0 (full)
+//        (the response follows the modulators of the SoundFont, by default half velocity is about 12dB softer)
 TSFDEF void tsf_channel_note_on(tsf* f, int channel, int key, float vel);
 TSFDEF void tsf_channel_note_off(tsf* f, int channel, int key);
 TSFDEF void tsf_channel_note_off_all(tsf* f, int channel); //end with sustain and release
 TSFDEF void tsf_channel_sounds_off_all(tsf* f, int channel); //end immediatly
 
 // Apply a MIDI control change to the channel (not all controllers are supported!)
+// The sustain and sostenuto pedals (64 and 66) hold notes after their note off until
+// the pedal is released, the soft pedal (67) makes notes started while it's held softer.
+// All controllers are also sources of the modulators of the SoundFont.
 TSFDEF void tsf_channel_midi_control(tsf* f, int channel, int controller, int control_value);
 
+// Apply a MIDI channel pressure (aftertouch) to all notes of the channel, or a MIDI polyphonic key
+// pressure to the notes of a single key (pressure from 0 to 127)
+// Both are sources of the modulators of the SoundFont, see tsf_channel_set_pressure_response to
+// let them shape the notes without modulators.
+TSFDEF void tsf_channel_midi_pressure(tsf* f, int channel, int pressure);
+TSFDEF void tsf_channel_midi_key_pressure(tsf* f, int channel, int key, int pressure);
+
+// Let channel pressure, key pressure and the breath controller (2) shape the notes of a channel on top
+// of the modulators of the SoundFont, the strongest of the three is used (default: all 0, disabled)
+// This is not reset by tsf_channel_midi_control or tsf_midi_sysex.
+//   vibrato_cents: depth of the vibrato at full pressure from 0 to 100 cents
+//   filter_cents: opening of the low-pass filter at full pressure from 0 to 4800 cents
+//   volume_db: attenuation of notes without pressure from 0 to 96 dB, at full pressure notes play at their normal volume
+TSFDEF void tsf_channel_set_pressure_response(tsf* f, int channel, float vibrato_cents, float filter_cents, float volume_db);
+
+// Per-note controls of a key of the channel, affecting the voices playing it and the notes started on it
+// They can be sent before the note on and are reset to the defaults by its note off and by resetting all controllers.
+//   semitones: pitch bend of the note in semitones (default 0.0)
+//   volume: linear volume scale factor of the note (default 1.0 full)
+//   pan: stereo panning of the note from 0.0 (left) to 1.0 (right), added to the channel pan (default 0.5 center)
+//   cents: shift of the low-pass filter cutoff of the note in cents (default 0.0)
+TSFDEF void tsf_channel_set_note_pitchbend(tsf* f, int channel, int key, float semitones);
+TSFDEF void tsf_channel_set_note_volume(tsf* f, int channel, int key, float volume);
+TSFDEF void tsf_channel_set_note_pan(tsf* f, int channel, int key, float pan);
+TSFDEF void tsf_channel_set_note_filter(tsf* f, int channel, int key, float cents);
+
+// Apply a MIDI program change to the channel, using the drum kits of bank 128 on drum channels
+// Returns 0 if no matching preset exists, otherwise 1
+TSFDEF int tsf_channel_midi_program(tsf* f, int channel, int program);
+
+// Set if a channel plays drums (default: only channel 10, which is channel number 9)
+// Takes effect with the next program change, or immediately when selecting the default kit.
+TSFDEF void tsf_channel_set_drums(tsf* f, int channel, int flag_drums);
+
+// Set an additional volume of a channel for mixing (default 1.0 full)
+// Unlike tsf_channel_set_volume this is combined with the MIDI volume and expression
+// controllers and is not reset by them, tsf_channel_midi_control or tsf_midi_sysex.
+TSFDEF void tsf_channel_set_mixvolume(tsf* f, int channel, float volume);
+
+// Apply a MIDI system exclusive message, data may start with or without the 0xF0 status byte
+// Supported are GM System On, GS Reset, XG System On, Master Volume and GS Use For Rhythm Part
+// Returns 1 if the message was applied, 0 if it was ignored
+TSFDEF int tsf_midi_sysex(tsf* f, const void* data, int length);
+
+// Bring a channel back into the state a GM System On leaves it in (program, controllers, pitch wheel,
+// tuning and drums) without ending the notes it is playing
+TSFDEF void tsf_channel_reset(tsf* f, int channel);
+
 // Get current values set on the channels
 TSFDEF int tsf_channel_get_preset_index(tsf* f, int channel);
 TSFDEF int tsf_channel_get_preset_bank(tsf* f, int channel);
@@ -220,6 +310,10 @@ TSFDEF float tsf_channel_get_volume(tsf* f, int channel);
 TSFDEF int tsf_channel_get_pitchwheel(tsf* f, int channel);
 TSFDEF float tsf_channel_get_pitchrange(tsf* f, int channel);
 TSFDEF float tsf_channel_get_tuning(tsf* f, int channel);
+TSFDEF int tsf_channel_get_drums(tsf* f, int channel);
+TSFDEF float tsf_channel_get_mixvolume(tsf* f, int channel);
+TSFDEF int tsf_channel_get_pressure(tsf* f, int channel);
+TSFDEF int tsf_channel_get_key_pressure(tsf* f, int channel, int key);
 
 #ifdef __cplusplus
 #  undef CPP_DEFAULT0
@@ -243,6 +337,10 @@ TSFDEF float tsf_channel_get_tuning(tsf* f, int channel);
 // Grace release time for quick voice off (avoid clicking noise)
 #define TSF_FASTRELEASETIME 0.01f
 
+// Attenuation in decibels and lowered filter cutoff in cents of notes started while the soft pedal is held
+#define TSF_SOFTPEDAL_ATTENUATION 4.0f
+#define TSF_SOFTPEDAL_FILTERFC 1200.0f
+
 #if !defined(TSF_MALLOC) || !defined(TSF_FREE) || !defined(TSF_REALLOC)
 #  include <stdlib.h>
 #  define TSF_MALLOC  malloc
@@ -313,6 +411,8 @@ struct tsf
 	enum TSFOutputMode outputmode;
 	float outSampleRate;
 	float globalGainDB;
+	int* refCount; //of the presets and samples shared by copies, NULL if never copied
+	struct tsf_effects* effects;
 };
 
 #ifndef TSF_NO_STDIO
@@ -393,6 +493,8 @@ struct tsf_voice_envelope { float level, slope; int samplesUntilNextSegment; sho
 struct tsf_voice_lowpass { double QInv, a0, a1, b1, b2, z1, z2; TSF_BOOL active; };
 struct tsf_voice_lfo { int samplesUntil; float level, delta; };
 
+struct tsf_modulator { tsf_u16 srcOper, destOper, amtSrcOper, transOper; float amount; };
+
 struct tsf_region
 {
 	int loop_mode;
@@ -400,7 +502,7 @@ struct tsf_region
 	unsigned char lokey, hikey, lovel, hivel;
 	unsigned int group, offset, end, loop_start, loop_end;
 	int transpose, tune, pitch_keycenter, pitch_keytrack;
-	float attenuation, pan;
+	float attenuation, pan, chorusSend, reverbSend;
 	struct tsf_envelope ampenv, modenv;
 	int initialFilterQ, initialFilterFc;
 	int modEnvToPitch, modEnvToFilterFc, modLfoToFilterFc, modLfoToVolume;
@@ -408,6 +510,8 @@ struct tsf_region
 	int freqModLFO, modLfoToPitch;
 	float delayVibLFO;
 	int freqVibLFO, vibLfoToPitch;
+	struct tsf_modulator* modulators;
+	int modulatorNum;
 };
 
 struct tsf_preset
@@ -418,23 +522,37 @@ struct tsf_preset
 	int regionNum;
 };
 
+// Generator offsets of the modulators applied to a voice, pan and effect sends in permille, pitch in cents, others like the generators
+struct tsf_voice_modulation { float attenuation, pan, filterFc, filterQ, pitch, reverbSend, chorusSend, modLfoToPitch, vibLfoToPitch, modEnvToPitch, modLfoToFilterFc, modEnvToFilterFc, modLfoToVolume; };
+
+// Per-note controls of a key, pan in -0.5 to 0.5 and pitch in semitones
+struct tsf_voice_pernote { float pitch, gainDB, pan, filterFc; };
+
 struct tsf_voice
 {
 	int playingPreset, playingKey, playingChannel;
+	short midiVelocity;
 	struct tsf_region* region;
 	double pitchInputTimecents, pitchOutputFactor;
 	double sourceSamplePosition;
-	float  noteGainDB, panFactorLeft, panFactorRight;
+	float  noteGainDB, panFactorLeft, panFactorRight, filterFc, reverbSend, chorusSend;
 	unsigned int playIndex, loopStart, loopEnd;
+	unsigned char noteOffPending, sostenuto; //note off held back by a pedal, held by the sostenuto pedal
 	struct tsf_voice_envelope ampenv, modenv;
 	struct tsf_voice_lowpass lowpass;
 	struct tsf_voice_lfo modlfo, viblfo;
+	struct tsf_voice_modulation modulation;
+	struct tsf_voice_pernote perNote;
 };
 
 struct tsf_channel
 {
 	unsigned short presetIndex, bank, pitchWheel, midiPan, midiVolume, midiExpression, midiRPN, midiData;
-	float panOffset, gainDB, pitchRange, tuning;
+	unsigned char midiControls[128], midiKeyPressure[128], midiPressure; //sources of the modulators
+	float panOffset, gainDB, mixGainDB, pitchRange, tuning;
+	float pressureVibrato, pressureFilterFc, pressureAttenuation; //in cents and centibels, see tsf_channel_set_pressure_response
+	struct tsf_voice_pernote perNote[128]; //applied to the voices of each key
+	int drums, sustain, sostenuto, soft;
 };
 
 struct tsf_channels
@@ -442,6 +560,31 @@ struct tsf_channels
 	void (*setupVoice)(tsf* f, struct tsf_voice* voice);
 	struct tsf_channel* channels;
 	int channelNum, activeChannel;
+	float masterGainDB;
+};
+
+#define TSF_REVERB_COMBS 8
+#define TSF_REVERB_ALLPASSES 4
+
+// Base delay of the chorus in seconds, modulated by up to the chorus depth
+#define TSF_CHORUS_DELAY 0.01f
+#define TSF_CHORUS_MAXDEPTH 20.0f
+
+struct tsf_effect_delay { float* buffer; int size, index; float store; };
+
+struct tsf_effects
+{
+	TSF_BOOL reverbOn, chorusOn;
+	float roomSize, damping, width, reverbLevel;
+	float chorusDepth, chorusRate, chorusLevel, chorusPhase;
+	float sampleRate; //the delay lines are set up for, 0 if not set up yet
+	int reverbTail, chorusTail; //samples left to render after the last voice sent to the effect
+	float *reverbInput, *chorusInput; //send buses of the block being rendered, NULL if not used
+	float *inputs, *lines;
+	int inputSize;
+	struct tsf_effect_delay combL[TSF_REVERB_COMBS], combR[TSF_REVERB_COMBS];
+	struct tsf_effect_delay allpassL[TSF_REVERB_ALLPASSES], allpassR[TSF_REVERB_ALLPASSES];
+	struct tsf_effect_delay chorus;
 };
 
 static double tsf_timecents2Secsd(double timecents) { return TSF_POW(2.0, timecents / 1200.0); }
@@ -537,8 +680,8 @@ static void tsf_region_operator(struct tsf_region* region, tsf_u16 genOper, unio
 		{ GEN_UINT_ADD15                   , _TSFREGIONOFFSET(unsigned int, end                  ) }, //12 EndAddrsCoarseOffset
 		{ GEN_INT   | GEN_INT_LIMIT960     , _TSFREGIONOFFSET(         int, modLfoToVolume       ) }, //13 ModLfoToVolume
 		{ 0                                , (0                                                  ) }, //   Unused
-		{ 0                                , (0                                                  ) }, //15 ChorusEffectsSend (unsupported)
-		{ 0                                , (0                                                  ) }, //16 ReverbEffectsSend (unsupported)
+		{ GEN_FLOAT | GEN_FLOAT_MAX1000    , _TSFREGIONOFFSET(       float, chorusSend           ) }, //15 ChorusEffectsSend
+		{ GEN_FLOAT | GEN_FLOAT_MAX1000    , _TSFREGIONOFFSET(       float, reverbSend           ) }, //16 ReverbEffectsSend
 		{ GEN_FLOAT | GEN_FLOAT_LIMITPAN   , _TSFREGIONOFFSET(       float, pan                  ) }, //17 Pan
 		{ 0                                , (0                                                  ) }, //   Unused
 		{ 0                                , (0                                                  ) }, //   Unused
@@ -675,6 +818,90 @@ static void tsf_region_envtosecs(struct tsf_envelope* p, TSF_BOOL sustainIsGain)
 	else p->sustain = 1.0f - (p->sustain / 1000.0f);
 }
 
+// The default modulators of the SF2 spec. Volume, expression, pan and the pitch wheel are applied by
+// the channel on its own (native), so fonts changing those only add the difference to the default.
+static const struct { tsf_u16 srcOper, destOper; tsf_s16 amount; tsf_u16 amtSrcOper; TSF_BOOL native; } tsf_default_modulators[] =
+{
+	{ 0x0502, 48,   960, 0x0000, TSF_FALSE }, // Note-On Velocity to Initial Attenuation
+	{ 0x0102,  8, -2400, 0x0000, TSF_FALSE }, // Note-On Velocity to Filter Cutoff
+	{ 0x000D,  6,    50, 0x0000, TSF_FALSE }, // Channel Pressure to Vibrato LFO Pitch Depth
+	{ 0x0081,  6,    50, 0x0000, TSF_FALSE }, // CC1 Modulation Wheel to Vibrato LFO Pitch Depth
+	{ 0x0587, 48,   960, 0x0000, TSF_TRUE  }, // CC7 Volume to Initial Attenuation
+	{ 0x028A, 17,  1000, 0x0000, TSF_TRUE  }, // CC10 Pan to Pan Position
+	{ 0x058B, 48,   960, 0x0000, TSF_TRUE  }, // CC11 Expression to Initial Attenuation
+	{ 0x00DB, 16,   200, 0x0000, TSF_FALSE }, // CC91 Reverb Send to Reverb Effects Send
+	{ 0x00DD, 15,   200, 0x0000, TSF_FALSE }, // CC93 Chorus Send to Chorus Effects Send
+	{ 0x020E, 52, 12700, 0x0010, TSF_TRUE  }, // Pitch Wheel to Fine Tune, scaled by the Pitch Wheel Sensitivity
+};
+
+static TSF_BOOL tsf_modulator_source_valid(tsf_u16 src, TSF_BOOL primary)
+{
+	int index = (src & 0x7F);
+	if ((src >> 10) > 3) return TSF_FALSE; //unknown curve type
+	if (src & 0x80) return (index != 0 && index != 6 && (index < 32 || index > 63) && (index < 98 || index > 101) && index < 120);
+	if (index == 0) return !primary; //a modulator without a source does nothing, without an amount source it is unscaled
+	return (index == 2 || index == 3 || index == 10 || index == 13 || index == 14 || index == 16);
+}
+
+// Add a modulator to the list, replacing or adding to the amount of an identical one
+static void tsf_modulator_merge(struct tsf_modulator** mods, int* num, tsf_u16 srcOper, tsf_u16 destOper, float amount, tsf_u16 amtSrcOper, tsf_u16 transOper, TSF_BOOL additive)
+{
+	struct tsf_modulator *mod, *modEnd, *newMods;
+	if (!tsf_modulator_source_valid(srcOper, TSF_TRUE) || !tsf_modulator_source_valid(amtSrcOper, TSF_FALSE)) return;
+	if (destOper > 58 || (transOper != 0 && transOper != 2)) return; //linked modulators are not supported
+	for (mod = *mods, modEnd = mod + *num; mod != modEnd; mod++)
+	{
+		if (mod->srcOper != srcOper || mod->destOper != destOper || mod->amtSrcOper != amtSrcOper || mod->transOper != transOper) continue;
+		mod->amount = (additive ? mod->amount + amount : amount);
+		return;
+	}
+	newMods = (struct tsf_modulator*)TSF_REALLOC(*mods, (*num + 1) * sizeof(struct tsf_modulator));
+	if (!newMods) return;
+	mod = &newMods[(*num)++];
+	mod->srcOper = srcOper, mod->destOper = destOper, mod->amtSrcOper = amtSrcOper, mod->transOper = transOper;
+	mod->amount = amount;
+	*mods = newMods;
+}
+
+// Set up the modulators of a region from the defaults, the global and local instrument zone (each replacing
+// identical modulators of the previous) and the global and local preset zone (which add to the instrument)
+static void tsf_region_modulators(struct tsf_region* region, struct tsf_hydra *hydra, struct tsf_hydra_ibag** pibags, struct tsf_hydra_pbag** ppbags)
+{
+	struct tsf_modulator *presetMods = TSF_NULL, *mod, *modEnd, *modOut;
+	int presetModNum = 0, i, j, n;
+	region->modulators = TSF_NULL;
+	region->modulatorNum = 0;
+	for (i = 0; i != sizeof(tsf_default_modulators) / sizeof(tsf_default_modulators[0]); i++)
+		tsf_modulator_merge(&region->modulators, &region->modulatorNum, tsf_default_modulators[i].srcOper, tsf_default_modulators[i].destOper, tsf_default_modulators[i].amount, tsf_default_modulators[i].amtSrcOper, 0, TSF_FALSE);
+	for (i = 0; i != 2; i++)
+	{
+		if (pibags[i]) for (j = pibags[i]->instModNdx, n = pibags[i][1].instModNdx; j < n && j < hydra->imodNum; j++)
+		{
+			struct tsf_hydra_imod* pimod = &hydra->imods[j];
+			tsf_modulator_merge(&region->modulators, &region->modulatorNum, pimod->modSrcOper, pimod->modDestOper, pimod->modAmount, pimod->modAmtSrcOper, pimod->modTransOper, TSF_FALSE);
+		}
+		if (ppbags[i]) for (j = ppbags[i]->modNdx, n = ppbags[i][1].modNdx; j < n && j < hydra->pmodNum; j++)
+		{
+			struct tsf_hydra_pmod* ppmod = &hydra->pmods[j];
+			tsf_modulator_merge(&presetMods, &presetModNum, ppmod->modSrcOper, ppmod->modDestOper, ppmod->modAmount, ppmod->modAmtSrcOper, ppmod->modTransOper, TSF_FALSE);
+		}
+	}
+	for (mod = presetMods, modEnd = mod + presetModNum; mod != modEnd; mod++)
+		tsf_modulator_merge(&region->modulators, &region->modulatorNum, mod->srcOper, mod->destOper, mod->amount, mod->amtSrcOper, mod->transOper, TSF_TRUE);
+	TSF_FREE(presetMods);
+
+	// Leave only what the channel doesn't apply itself and drop modulators without an effect
+	for (mod = modOut = region->modulators, modEnd = mod + region->modulatorNum; mod != modEnd; mod++)
+	{
+		for (i = 0; i != sizeof(tsf_default_modulators) / sizeof(tsf_default_modulators[0]); i++)
+			if (tsf_default_modulators[i].native && mod->srcOper == tsf_default_modulators[i].srcOper && mod->destOper == tsf_default_modulators[i].destOper
+				&& mod->amtSrcOper == tsf_default_modulators[i].amtSrcOper && mod->transOper == 0)
+				mod->amount -= tsf_default_modulators[i].amount;
+		if (mod->amount) *modOut++ = *mod;
+	}
+	region->modulatorNum = (int)(modOut - region->modulators);
+}
+
 static void tsf_load_presets(tsf* res, struct tsf_hydra *hydra, unsigned int fontSampleCount)
 {
 	enum { GenInstrument = 41, GenKeyRange = 43, GenVelRange = 44, GenSampleID = 53 };
@@ -685,7 +912,7 @@ static void tsf_load_presets(tsf* res, struct tsf_hydra *hydra, unsigned int fon
 		int sortedIndex = 0, region_index = 0;
 		struct tsf_hydra_phdr *otherphdr;
 		struct tsf_preset* preset;
-		struct tsf_hydra_pbag *ppbag, *ppbagEnd;
+		struct tsf_hydra_pbag *ppbag, *ppbagEnd, *ppbags[2] = { TSF_NULL, TSF_NULL }; //global and current zone
 		struct tsf_region globalRegion;
 		for (otherphdr = hydra->phdrs; otherphdr != pphdrMax; otherphdr++)
 		{
@@ -737,6 +964,7 @@ static void tsf_load_presets(tsf* res, struct tsf_hydra *hydra, unsigned int fon
 			struct tsf_hydra_pgen *ppgen, *ppgenEnd; struct tsf_hydra_inst *pinst; struct tsf_hydra_ibag *pibag, *pibagEnd; struct tsf_hydra_igen *pigen, *pigenEnd;
 			struct tsf_region presetRegion = globalRegion;
 			int hadGenInstrument = 0;
+			ppbags[1] = ppbag;
 
 			// Generators.
 			for (ppgen = hydra->pgens + ppbag->genNdx, ppgenEnd = hydra->pgens + ppbag[1].genNdx; ppgen != ppgenEnd; ppgen++)
@@ -745,6 +973,7 @@ static void tsf_load_presets(tsf* res, struct tsf_hydra *hydra, unsigned int fon
 				if (ppgen->genOper == GenInstrument)
 				{
 					struct tsf_region instRegion;
+					struct tsf_hydra_ibag* pibags[2] = { TSF_NULL, TSF_NULL }; //global and current zone
 					tsf_u16 whichInst = ppgen->genAmount.wordAmount;
 					if (whichInst >= hydra->instNum) continue;
 
@@ -755,6 +984,7 @@ static void tsf_load_presets(tsf* res, struct tsf_hydra *hydra, unsigned int fon
 						// Generators.
 						struct tsf_region zoneRegion = instRegion;
 						int hadSampleID = 0;
+						pibags[1] = pibag;
 						for (pigen = hydra->igens + pibag->instGenNdx, pigenEnd = hydra->igens + pibag[1].instGenNdx; pigen != pigenEnd; pigen++)
 						{
 							if (pigen->genOper == GenSampleID)
@@ -793,6 +1023,8 @@ static void tsf_load_presets(tsf* res, struct tsf_hydra *hydra, unsigned int fon
 								if (zoneRegion.end && zoneRegion.end < fontSampleCount) zoneRegion.end++;
 								else zoneRegion.end = fontSampleCount;
 
+								tsf_region_modulators(&zoneRegion, hydra, pibags, ppbags);
+
 								preset->regions[region_index] = zoneRegion;
 								region_index++;
 								hadSampleID = 1;
@@ -802,23 +1034,20 @@ static void tsf_load_presets(tsf* res, struct tsf_hydra *hydra, unsigned int fon
 
 						// Handle instrument's global zone.
 						if (pibag == hydra->ibags + pinst->instBagNdx && !hadSampleID)
-							instRegion = zoneRegion;
-
-						// Modulators (TODO)
-						//if (ibag->instModNdx < ibag[1].instModNdx) addUnsupportedOpcode("any modulator");
+							instRegion = zoneRegion, pibags[0] = pibag;
 					}
 					hadGenInstrument = 1;
 				}
 				else tsf_region_operator(&presetRegion, ppgen->genOper, &ppgen->genAmount, TSF_NULL);
 			}
 
-			// Modulators (TODO)
-			//if (pbag->modNdx < pbag[1].modNdx) addUnsupportedOpcode("any modulator");
-
 			// Handle preset's global zone.
 			if (ppbag == hydra->pbags + pphdr->presetBagNdx && !hadGenInstrument)
-				globalRegion = presetRegion;
+				globalRegion = presetRegion, ppbags[0] = ppbag;
 		}
+
+		// Zones filtered out by inherited key or velocity ranges were counted above
+		preset->regionNum = region_index;
 	}
 }
 
@@ -1047,10 +1276,121 @@ static void tsf_voice_calcpitchratio(struct tsf_voice* v, float pitchShift, floa
 	double note = v->playingKey + v->region->transpose + v->region->tune / 100.0;
 	double adjustedPitch = v->region->pitch_keycenter + (note - v->region->pitch_keycenter) * (v->region->pitch_keytrack / 100.0);
 	if (pitchShift) adjustedPitch += pitchShift;
+	if (v->modulation.pitch) adjustedPitch += v->modulation.pitch / 100.0;
+	if (v->perNote.pitch) adjustedPitch += v->perNote.pitch;
 	v->pitchInputTimecents = adjustedPitch * 100.0;
 	v->pitchOutputFactor = v->region->sample_rate / (tsf_timecents2Secsd(v->region->pitch_keycenter * 100.0) * outSampleRate);
 }
 
+static void tsf_voice_calcpan(struct tsf_voice* v, float panOffset)
+{
+	// The SFZ spec is silent about the pan curve, but a 3dB pan law seems common. This sqrt() curve matches what Dimension LE does; Alchemy Free seems closer to sin(adjustedPan * pi/2).
+	float newpan = v->region->pan + v->modulation.pan / 1000.0f + v->perNote.pan + panOffset;
+	if      (newpan <= -0.5f) { v->panFactorLeft = 1.0f; v->panFactorRight = 0.0f; }
+	else if (newpan >=  0.5f) { v->panFactorLeft = 0.0f; v->panFactorRight = 1.0f; }
+	else { v->panFactorLeft = TSF_SQRTF(0.5f - newpan); v->panFactorRight = TSF_SQRTF(0.5f + newpan); }
+}
+
+static void tsf_voice_lowpass_update(struct tsf_voice* v, float outSampleRate)
+{
+	float lowpassFc = (v->filterFc <= 13500 ? tsf_cents2Hertz(v->filterFc) / outSampleRate : 1.0f);
+	float lowpassFilterQ = v->region->initialFilterQ + v->modulation.filterQ;
+	if (lowpassFilterQ < 0) lowpassFilterQ = 0;
+	else if (lowpassFilterQ > 960) lowpassFilterQ = 960;
+	v->lowpass.QInv = 1.0 / TSF_POW(10.0, (lowpassFilterQ / 200.0));
+	v->lowpass.active = (lowpassFc < 0.499f);
+	if (v->lowpass.active) tsf_voice_lowpass_setup(&v->lowpass, lowpassFc);
+}
+
+static float tsf_modulator_curve(int type, float x)
+{
+	float y;
+	switch (type)
+	{
+		case 1: y = (x >= 1.0f ? 1.0f : (float)(-(40.0 / 96.0) * TSF_LOG10(1.0 - x))); break; //concave
+		case 2: y = (x <= 0.0f ? 0.0f : (float)(1.0 + (40.0 / 96.0) * TSF_LOG10(x))); break; //convex
+		case 3: return (x >= 0.5f ? 1.0f : 0.0f); //switch
+		default: return x; //linear
+	}
+	return (y < 0.0f ? 0.0f : (y > 1.0f ? 1.0f : y));
+}
+
+// Returns the value of a modulator source, between 0 and 1 if unipolar or between -1 and 1 if bipolar
+static float tsf_modulator_source(struct tsf_voice* v, struct tsf_channel* c, tsf_u16 src)
+{
+	float x;
+	if (src & 0x80) x = (c ? c->midiControls[src & 0x7F] / 127.0f : 0.0f);
+	else switch (src & 0x7F)
+	{
+		case  2 /*NOTE_ON_VELOCITY*/ : x = v->midiVelocity / 127.0f; break;
+		case  3 /*NOTE_ON_KEY*/      : x = v->playingKey / 127.0f; break;
+		case 10 /*POLY_PRESSURE*/    : x = (c ? c->midiKeyPressure[v->playingKey & 0x7F] / 127.0f : 0.0f); break;
+		case 13 /*CHANNEL_PRESSURE*/ : x = (c ? c->midiPressure / 127.0f : 0.0f); break;
+		case 14 /*PITCH_WHEEL*/      : x = (c ? c->pitchWheel / 16383.0f : 0.5f); break;
+		case 16 /*PITCH_WHEEL_SENS*/ : x = (c ? c->pitchRange : 2.0f) / 127.0f; break;
+		default: return 1.0f; //no controller
+	}
+	if (x < 0.0f) x = 0.0f;
+	else if (x > 1.0f) x = 1.0f;
+	if (src & 0x100) x = 1.0f - x; //negative direction
+	if (src & 0x200) return (x >= 0.5f ? tsf_modulator_curve(src >> 10, 2.0f * x - 1.0f) : -tsf_modulator_curve(src >> 10, 1.0f - 2.0f * x)); //bipolar
+	return tsf_modulator_curve(src >> 10, x);
+}
+
+// Evaluate the modulators of a voice and apply the change to its gain, filter and effect sends
+// Returns TSF_TRUE if anything changed, the pan, pitch and low-pass filter are then left to the caller to update
+static TSF_BOOL tsf_voice_modulate(struct tsf_voice* v, struct tsf_channel* c)
+{
+	struct tsf_voice_modulation m;
+	struct tsf_modulator *mod = v->region->modulators, *modEnd = mod + v->region->modulatorNum;
+	float reverb, chorus;
+	int i;
+	TSF_MEMSET(&m, 0, sizeof(m));
+	for (; mod != modEnd; mod++)
+	{
+		float value = mod->amount * tsf_modulator_source(v, c, mod->srcOper) * tsf_modulator_source(v, c, mod->amtSrcOper);
+		if (mod->transOper == 2 && value < 0) value = -value; //absolute value
+		switch (mod->destOper)
+		{
+			case  5 /*ModLfoToPitch*/     : m.modLfoToPitch    += value; break;
+			case  6 /*VibLfoToPitch*/     : m.vibLfoToPitch    += value; break;
+			case  7 /*ModEnvToPitch*/     : m.modEnvToPitch    += value; break;
+			case  8 /*InitialFilterFc*/   : m.filterFc         += value; break;
+			case  9 /*InitialFilterQ*/    : m.filterQ          += value; break;
+			case 10 /*ModLfoToFilterFc*/  : m.modLfoToFilterFc += value; break;
+			case 11 /*ModEnvToFilterFc*/  : m.modEnvToFilterFc += value; break;
+			case 13 /*ModLfoToVolume*/    : m.modLfoToVolume   += value; break;
+			case 15 /*ChorusEffectsSend*/ : m.chorusSend       += value; break;
+			case 16 /*ReverbEffectsSend*/ : m.reverbSend       += value; break;
+			case 17 /*Pan*/               : m.pan              += value; break;
+			case 48 /*InitialAttenuation*/: m.attenuation      += value; break;
+			case 51 /*CoarseTune*/        : m.pitch            += value * 100.0f; break;
+			case 52 /*FineTune*/          : m.pitch            += value; break;
+		}
+	}
+	if (c && (c->pressureVibrato || c->pressureFilterFc || c->pressureAttenuation))
+	{
+		// the strongest of channel pressure, key pressure and breath, so they don't add up
+		int pressure = c->midiPressure;
+		if (v->playingKey >= 0 && v->playingKey < 128 && c->midiKeyPressure[v->playingKey] > pressure) pressure = c->midiKeyPressure[v->playingKey];
+		if (c->midiControls[2] > pressure) pressure = c->midiControls[2];
+		m.vibLfoToPitch += c->pressureVibrato * pressure / 127.0f;
+		m.filterFc += c->pressureFilterFc * pressure / 127.0f;
+		m.attenuation += c->pressureAttenuation * (127 - pressure) / 127.0f;
+	}
+	for (i = 0; i != sizeof(m) / sizeof(float); i++)
+		if (((float*)&m)[i] != ((float*)&v->modulation)[i]) break;
+	if (i == sizeof(m) / sizeof(float)) return TSF_FALSE;
+	v->noteGainDB -= (m.attenuation - v->modulation.attenuation) / 10.0f;
+	v->filterFc += m.filterFc - v->modulation.filterFc;
+	reverb = (v->region->reverbSend + m.reverbSend) / 1000.0f;
+	chorus = (v->region->chorusSend + m.chorusSend) / 1000.0f;
+	v->reverbSend = (reverb < 0.0f ? 0.0f : (reverb > 1.0f ? 1.0f : reverb));
+	v->chorusSend = (chorus < 0.0f ? 0.0f : (chorus > 1.0f ? 1.0f : chorus));
+	v->modulation = m;
+	return TSF_TRUE;
+}
+
 static void tsf_voice_render(tsf* f, struct tsf_voice* v, float* outputBuffer, int numSamples)
 {
 	struct tsf_region* region = v->region;
@@ -1058,38 +1398,48 @@ static void tsf_voice_render(tsf* f, struct tsf_voice* v, float* outputBuffer, i
 	float* outL = outputBuffer;
 	float* outR = (f->outputmode == TSF_STEREO_UNWEAVED ? outL + numSamples : TSF_NULL);
 
+	// Depths of the region together with the modulators.
+	float modLfoToPitch = region->modLfoToPitch + v->modulation.modLfoToPitch, vibLfoToPitch = region->vibLfoToPitch + v->modulation.vibLfoToPitch;
+	float modEnvToPitch = region->modEnvToPitch + v->modulation.modEnvToPitch, modLfoToVolume = region->modLfoToVolume + v->modulation.modLfoToVolume;
+	float modLfoToFilterFc = region->modLfoToFilterFc + v->modulation.modLfoToFilterFc, modEnvToFilterFc = region->modEnvToFilterFc + v->modulation.modEnvToFilterFc;
+
 	// Cache some values, to give them at least some chance of ending up in registers.
-	TSF_BOOL updateModEnv = (region->modEnvToPitch || region->modEnvToFilterFc);
-	TSF_BOOL updateModLFO = (v->modlfo.delta && (region->modLfoToPitch || region->modLfoToFilterFc || region->modLfoToVolume));
-	TSF_BOOL updateVibLFO = (v->viblfo.delta && (region->vibLfoToPitch));
+	TSF_BOOL updateModEnv = (modEnvToPitch || modEnvToFilterFc);
+	TSF_BOOL updateModLFO = (v->modlfo.delta && (modLfoToPitch || modLfoToFilterFc || modLfoToVolume));
+	TSF_BOOL updateVibLFO = (v->viblfo.delta && (vibLfoToPitch));
 	TSF_BOOL isLooping    = (v->loopStart < v->loopEnd);
 	unsigned int tmpLoopStart = v->loopStart, tmpLoopEnd = v->loopEnd;
 	double tmpSampleEndDbl = (double)region->end, tmpLoopEndDbl = (double)tmpLoopEnd + 1.0;
 	double tmpSourceSamplePosition = v->sourceSamplePosition;
 	struct tsf_voice_lowpass tmpLowpass = v->lowpass;
 
-	TSF_BOOL dynamicLowpass = (region->modLfoToFilterFc || region->modEnvToFilterFc);
+	TSF_BOOL dynamicLowpass = (modLfoToFilterFc || modEnvToFilterFc);
 	float tmpSampleRate = f->outSampleRate, tmpInitialFilterFc, tmpModLfoToFilterFc, tmpModEnvToFilterFc;
 
-	TSF_BOOL dynamicPitchRatio = (region->modLfoToPitch || region->modEnvToPitch || region->vibLfoToPitch);
+	TSF_BOOL dynamicPitchRatio = (modLfoToPitch || modEnvToPitch || vibLfoToPitch);
 	double pitchRatio;
 	float tmpModLfoToPitch, tmpVibLfoToPitch, tmpModEnvToPitch;
 
-	TSF_BOOL dynamicGain = (region->modLfoToVolume != 0);
+	TSF_BOOL dynamicGain = (modLfoToVolume != 0);
 	float noteGain = 0, tmpModLfoToVolume;
 
-	if (dynamicLowpass) tmpInitialFilterFc = (float)region->initialFilterFc, tmpModLfoToFilterFc = (float)region->modLfoToFilterFc, tmpModEnvToFilterFc = (float)region->modEnvToFilterFc;
+	float *reverbIn = TSF_NULL, *chorusIn = TSF_NULL;
+
+	if (dynamicLowpass) tmpInitialFilterFc = v->filterFc, tmpModLfoToFilterFc = modLfoToFilterFc, tmpModEnvToFilterFc = modEnvToFilterFc;
 	else tmpInitialFilterFc = 0, tmpModLfoToFilterFc = 0, tmpModEnvToFilterFc = 0;
 
-	if (dynamicPitchRatio) pitchRatio = 0, tmpModLfoToPitch = (float)region->modLfoToPitch, tmpVibLfoToPitch = (float)region->vibLfoToPitch, tmpModEnvToPitch = (float)region->modEnvToPitch;
+	if (dynamicPitchRatio) pitchRatio = 0, tmpModLfoToPitch = modLfoToPitch, tmpVibLfoToPitch = vibLfoToPitch, tmpModEnvToPitch = modEnvToPitch;
 	else pitchRatio = tsf_timecents2Secsd(v->pitchInputTimecents) * v->pitchOutputFactor, tmpModLfoToPitch = 0, tmpVibLfoToPitch = 0, tmpModEnvToPitch = 0;
 
-	if (dynamicGain) tmpModLfoToVolume = (float)region->modLfoToVolume * 0.1f;
+	if (dynamicGain) tmpModLfoToVolume = modLfoToVolume * 0.1f;
 	else noteGain = tsf_decibelsToGain(v->noteGainDB), tmpModLfoToVolume = 0;
 
+	if (f->effects && f->effects->reverbInput && v->reverbSend > 0) reverbIn = f->effects->reverbInput;
+	if (f->effects && f->effects->chorusInput && v->chorusSend > 0) chorusIn = f->effects->chorusInput;
+
 	while (numSamples)
 	{
-		float gainMono, gainLeft, gainRight;
+		float gainMono, gainLeft, gainRight, gainReverb, gainChorus;
 		int blockSamples = (numSamples > TSF_RENDER_EFFECTSAMPLEBLOCK ? TSF_RENDER_EFFECTSAMPLEBLOCK : numSamples);
 		numSamples -= blockSamples;
 
@@ -1108,6 +1458,7 @@ static void tsf_voice_render(tsf* f, struct tsf_voice* v, float* outputBuffer, i
 			noteGain = tsf_decibelsToGain(v->noteGainDB + (v->modlfo.level * tmpModLfoToVolume));
 
 		gainMono = noteGain * v->ampenv.level;
+		gainReverb = gainMono * v->reverbSend, gainChorus = gainMono * v->chorusSend;
 
 		// Update EG.
 		tsf_voice_envelope_process(&v->ampenv, blockSamples, tmpSampleRate);
@@ -1133,6 +1484,8 @@ static void tsf_voice_render(tsf* f, struct tsf_voice* v, float* outputBuffer, i
 
 					*outL++ += val * gainLeft;
 					*outL++ += val * gainRight;
+					if (reverbIn) *reverbIn++ += val * gainReverb;
+					if (chorusIn) *chorusIn++ += val * gainChorus;
 
 					// Next sample.
 					tmpSourceSamplePosition += pitchRatio;
@@ -1154,6 +1507,8 @@ static void tsf_voice_render(tsf* f, struct tsf_voice* v, float* outputBuffer, i
 
 					*outL++ += val * gainLeft;
 					*outR++ += val * gainRight;
+					if (reverbIn) *reverbIn++ += val * gainReverb;
+					if (chorusIn) *chorusIn++ += val * gainChorus;
 
 					// Next sample.
 					tmpSourceSamplePosition += pitchRatio;
@@ -1173,6 +1528,8 @@ static void tsf_voice_render(tsf* f, struct tsf_voice* v, float* outputBuffer, i
 					if (tmpLowpass.active) val = tsf_voice_lowpass_process(&tmpLowpass, val);
 
 					*outL++ += val * gainMono;
+					if (reverbIn) *reverbIn++ += val * gainReverb;
+					if (chorusIn) *chorusIn++ += val * gainChorus;
 
 					// Next sample.
 					tmpSourceSamplePosition += pitchRatio;
@@ -1192,7 +1549,193 @@ static void tsf_voice_render(tsf* f, struct tsf_voice* v, float* outputBuffer, i
 	if (tmpLowpass.active || dynamicLowpass) v->lowpass = tmpLowpass;
 }
 
+static struct tsf_effects* tsf_effects_init(tsf* f)
+{
+	struct tsf_effects* e;
+	if (f->effects) return f->effects;
+	e = f->effects = (struct tsf_effects*)TSF_MALLOC(sizeof(struct tsf_effects));
+	if (!e) return TSF_NULL;
+	TSF_MEMSET(e, 0, sizeof(struct tsf_effects));
+	e->reverbOn = e->chorusOn = TSF_TRUE;
+	e->roomSize = 0.2f, e->damping = 0.0f, e->width = 0.5f, e->reverbLevel = 0.9f;
+	e->chorusDepth = 8.0f, e->chorusRate = 0.3f, e->chorusLevel = 1.0f;
+	return e;
+}
+
+static void tsf_effects_clear(struct tsf_effects* e)
+{
+	int i;
+	for (i = 0; i < TSF_REVERB_COMBS; i++) e->combL[i].store = e->combR[i].store = 0;
+	if (e->sampleRate) TSF_MEMSET(e->lines, 0, (e->chorus.buffer + e->chorus.size - e->lines) * sizeof(float));
+	e->reverbTail = e->chorusTail = 0;
+}
+
+// Returns false if the delay lines could not be allocated
+static TSF_BOOL tsf_effects_setup(struct tsf_effects* e, float sampleRate)
+{
+	// Delay line lengths of Freeverb for 44.1 kHz
+	static const int combTuning[TSF_REVERB_COMBS] = { 1116, 1188, 1277, 1356, 1422, 1491, 1557, 1617 };
+	static const int allpassTuning[TSF_REVERB_ALLPASSES] = { 556, 441, 341, 225 };
+	const int stereoSpread = 23;
+	struct tsf_effect_delay* lines[2 * TSF_REVERB_COMBS + 2 * TSF_REVERB_ALLPASSES + 1];
+	float scale = sampleRate / 44100.0f, *buffer;
+	int i, n = 0, total = 0;
+	for (i = 0; i < TSF_REVERB_COMBS; i++)
+	{
+		e->combL[i].size = (int)(combTuning[i] * scale), lines[n++] = &e->combL[i];
+		e->combR[i].size = (int)((combTuning[i] + stereoSpread) * scale), lines[n++] = &e->combR[i];
+	}
+	for (i = 0; i < TSF_REVERB_ALLPASSES; i++)
+	{
+		e->allpassL[i].size = (int)(allpassTuning[i] * scale), lines[n++] = &e->allpassL[i];
+		e->allpassR[i].size = (int)((allpassTuning[i] + stereoSpread) * scale), lines[n++] = &e->allpassR[i];
+	}
+	e->chorus.size = (int)((TSF_CHORUS_DELAY + TSF_CHORUS_MAXDEPTH / 1000.0f) * sampleRate) + 2, lines[n++] = &e->chorus;
+	for (i = 0; i < n; i++)
+	{
+		if (lines[i]->size < 1) lines[i]->size = 1;
+		total += lines[i]->size;
+	}
+	TSF_FREE(e->lines);
+	buffer = e->lines = (float*)TSF_MALLOC(total * sizeof(float));
+	if (!buffer) { e->sampleRate = 0; return TSF_FALSE; }
+	for (i = 0; i < n; i++)
+	{
+		lines[i]->buffer = buffer, lines[i]->index = 0;
+		buffer += lines[i]->size;
+	}
+	e->sampleRate = sampleRate;
+	tsf_effects_clear(e);
+	return TSF_TRUE;
+}
+
+// Get the effects ready to receive the voices of the next block, returns NULL if none need to be rendered
+// When memory runs out the voices are rendered dry.
+static struct tsf_effects* tsf_effects_prepare(tsf* f, int samples)
+{
+	struct tsf_effects* e = f->effects;
+	struct tsf_voice *v = f->voices, *vEnd = v + f->voiceNum;
+	TSF_BOOL reverb = TSF_FALSE, chorus = TSF_FALSE;
+	for (; v != vEnd; v++)
+	{
+		if (v->playingPreset == -1) continue;
+		if (v->reverbSend > 0) reverb = TSF_TRUE;
+		if (v->chorusSend > 0) chorus = TSF_TRUE;
+	}
+	if (!e && !reverb && !chorus) return TSF_NULL;
+	if ((e = tsf_effects_init(f)) == TSF_NULL) return TSF_NULL;
+	e->reverbInput = e->chorusInput = TSF_NULL;
+	reverb = (reverb && e->reverbOn), chorus = (chorus && e->chorusOn);
+	if (!reverb && !chorus && e->reverbTail <= 0 && e->chorusTail <= 0) return TSF_NULL;
+	if (e->sampleRate != f->outSampleRate && !tsf_effects_setup(e, f->outSampleRate)) return TSF_NULL;
+	if (samples > e->inputSize)
+	{
+		TSF_FREE(e->inputs);
+		e->inputs = (float*)TSF_MALLOC(2 * samples * sizeof(float));
+		e->inputSize = (e->inputs ? samples : 0);
+		if (!e->inputs) return TSF_NULL;
+	}
+	if (reverb)
+	{
+		// long enough after this block for the longest comb filter to decay by 60 dB
+		float feedback = e->roomSize * 0.28f + 0.7f;
+		e->reverbInput = e->inputs;
+		e->reverbTail = samples + (int)(e->combR[TSF_REVERB_COMBS - 1].size * (-6.9f / TSF_LOG(feedback))) + e->allpassL[0].size * 4;
+		TSF_MEMSET(e->reverbInput, 0, samples * sizeof(float));
+	}
+	if (chorus)
+	{
+		e->chorusInput = e->inputs + e->inputSize;
+		e->chorusTail = samples + e->chorus.size;
+		TSF_MEMSET(e->chorusInput, 0, samples * sizeof(float));
+	}
+	return e;
+}
+
+static float tsf_effect_comb(struct tsf_effect_delay* d, float input, float feedback, float damp)
+{
+	float output = d->buffer[d->index];
+	d->store = output * (1.0f - damp) + d->store * damp;
+	if (d->store < 1e-20f && d->store > -1e-20f) d->store = 0; //avoid slow denormals in the decaying tail
+	d->buffer[d->index] = input + d->store * feedback;
+	if (++d->index == d->size) d->index = 0;
+	return output;
+}
+
+static float tsf_effect_allpass(struct tsf_effect_delay* d, float input)
+{
+	float output = d->buffer[d->index];
+	d->buffer[d->index] = input + output * 0.5f;
+	if (++d->index == d->size) d->index = 0;
+	return output - input;
+}
+
+static float tsf_effect_chorus_tap(struct tsf_effect_delay* d, float delay)
+{
+	float pos = (float)d->index - delay;
+	int i;
+	if (pos < 0) pos += d->size;
+	i = (int)pos;
+	return d->buffer[i] + (d->buffer[i + 1 == d->size ? 0 : i + 1] - d->buffer[i]) * (pos - i);
+}
+
+// Mix the output of the effects into a rendered block
+static void tsf_effects_render(tsf* f, struct tsf_effects* e, float* buffer, int samples)
+{
+	float feedback = e->roomSize * 0.28f + 0.7f, damp = e->damping * 0.4f;
+	float wet1 = e->reverbLevel * (e->width / 2.0f + 0.5f), wet2 = e->reverbLevel * ((1.0f - e->width) / 2.0f);
+	float depth = (e->chorusDepth < 0 ? 0 : (e->chorusDepth > TSF_CHORUS_MAXDEPTH ? TSF_CHORUS_MAXDEPTH : e->chorusDepth)) / 1000.0f * e->sampleRate;
+	float delay = TSF_CHORUS_DELAY * e->sampleRate, phaseDelta = e->chorusRate / e->sampleRate;
+	int stride = (f->outputmode == TSF_STEREO_INTERLEAVED ? 2 : 1), i, j;
+	TSF_BOOL reverb = (e->reverbOn && e->reverbTail > 0), chorus = (e->chorusOn && e->chorusTail > 0);
+	float* outL = buffer;
+	float* outR = (f->outputmode == TSF_STEREO_INTERLEAVED ? buffer + 1 : (f->outputmode == TSF_STEREO_UNWEAVED ? buffer + samples : TSF_NULL));
+
+	for (i = 0; i < samples; i++, outL += stride, outR += (outR ? stride : 0))
+	{
+		float left = 0, right = 0;
+		if (reverb)
+		{
+			float input = (e->reverbInput ? e->reverbInput[i] : 0) * 0.015f, combL = 0, combR = 0;
+			for (j = 0; j < TSF_REVERB_COMBS; j++)
+			{
+				combL += tsf_effect_comb(&e->combL[j], input, feedback, damp);
+				combR += tsf_effect_comb(&e->combR[j], input, feedback, damp);
+			}
+			for (j = 0; j < TSF_REVERB_ALLPASSES; j++)
+			{
+				combL = tsf_effect_allpass(&e->allpassL[j], combL);
+				combR = tsf_effect_allpass(&e->allpassR[j], combR);
+			}
+			left += combL * wet1 + combR * wet2;
+			right += combR * wet1 + combL * wet2;
+		}
+		if (chorus)
+		{
+			// two taps with triangle LFOs a quarter period apart
+			float phaseR = (e->chorusPhase < 0.75f ? e->chorusPhase + 0.25f : e->chorusPhase - 0.75f);
+			float lfoL = (e->chorusPhase < 0.5f ? 2.0f * e->chorusPhase : 2.0f - 2.0f * e->chorusPhase);
+			float lfoR = (phaseR < 0.5f ? 2.0f * phaseR : 2.0f - 2.0f * phaseR);
+			e->chorus.buffer[e->chorus.index] = (e->chorusInput ? e->chorusInput[i] : 0);
+			left += tsf_effect_chorus_tap(&e->chorus, delay + depth * lfoL) * e->chorusLevel;
+			right += tsf_effect_chorus_tap(&e->chorus, delay + depth * lfoR) * e->chorusLevel;
+			if (++e->chorus.index == e->chorus.size) e->chorus.index = 0;
+			e->chorusPhase += phaseDelta;
+			if (e->chorusPhase >= 1.0f) e->chorusPhase -= 1.0f;
+		}
+		if (outR) { *outL += left; *outR += right; }
+		else *outL += (left + right) * 0.5f;
+	}
+	if (reverb) e->reverbTail -= samples;
+	if (chorus) e->chorusTail -= samples;
+}
+
 TSFDEF tsf* tsf_load(struct tsf_stream* stream)
+{
+	return tsf_load_ex(stream, TSF_NULL);
+}
+
+TSFDEF tsf* tsf_load_ex(struct tsf_stream* stream, enum TSFError* e)
 {
 	tsf* res = TSF_NULL;
 	struct tsf_riffchunk chunkHead;
@@ -1201,9 +1744,10 @@ TSFDEF tsf* tsf_load(struct tsf_stream* stream)
 	float* fontSamples = TSF_NULL;
 	unsigned int fontSampleCount = 0;
 
+	if (e) *e = TSF_NO_ERROR;
 	if (!tsf_riffchunk_read(TSF_NULL, &chunkHead, stream) || !TSF_FourCCEquals(chunkHead.id, "sfbk"))
 	{
-		//if (e) *e = TSF_INVALID_NOSF2HEADER;
+		if (e) *e = TSF_INVALID_NOSF2HEADER;
 		return res;
 	}
 
@@ -1251,11 +1795,11 @@ TSFDEF tsf* tsf_load(struct tsf_stream* stream)
 	}
 	if (!hydra.phdrs || !hydra.pbags || !hydra.pmods || !hydra.pgens || !hydra.insts || !hydra.ibags || !hydra.imods || !hydra.igens || !hydra.shdrs)
 	{
-		//if (e) *e = TSF_INVALID_INCOMPLETE;
+		if (e) *e = TSF_INVALID_INCOMPLETE;
 	}
 	else if (fontSamples == TSF_NULL)
 	{
-		//if (e) *e = TSF_INVALID_NOSAMPLEDATA;
+		if (e) *e = TSF_INVALID_NOSAMPLEDATA;
 	}
 	else
 	{
@@ -1278,24 +1822,73 @@ TSFDEF tsf* tsf_load(struct tsf_stream* stream)
 TSFDEF void tsf_close(tsf* f)
 {
 	struct tsf_preset *preset, *presetEnd;
+	struct tsf_region *region, *regionEnd;
 	if (!f) return;
-	for (preset = f->presets, presetEnd = preset + f->presetNum; preset != presetEnd; preset++)
-		TSF_FREE(preset->regions);
-	TSF_FREE(f->presets);
-	TSF_FREE(f->fontSamples);
+	if (!f->refCount || !--(*f->refCount))
+	{
+		for (preset = f->presets, presetEnd = preset + f->presetNum; preset != presetEnd; preset++)
+		{
+			for (region = preset->regions, regionEnd = region + preset->regionNum; region != regionEnd; region++)
+				TSF_FREE(region->modulators);
+			TSF_FREE(preset->regions);
+		}
+		TSF_FREE(f->presets);
+		TSF_FREE(f->fontSamples);
+		TSF_FREE(f->refCount);
+	}
+	if (f->effects) { TSF_FREE(f->effects->inputs); TSF_FREE(f->effects->lines); TSF_FREE(f->effects); }
 	TSF_FREE(f->voices);
 	if (f->channels) { TSF_FREE(f->channels->channels); TSF_FREE(f->channels); }
 	TSF_FREE(f->outputSamples);
 	TSF_FREE(f);
 }
 
+TSFDEF tsf* tsf_copy(tsf* f)
+{
+	tsf* res;
+	if (!f) return TSF_NULL;
+	if (!f->refCount)
+	{
+		f->refCount = (int*)TSF_MALLOC(sizeof(int));
+		if (!f->refCount) return TSF_NULL;
+		*f->refCount = 1;
+	}
+	res = (tsf*)TSF_MALLOC(sizeof(tsf));
+	if (!res) return TSF_NULL;
+	TSF_MEMCPY(res, f, sizeof(tsf));
+	res->voices = TSF_NULL;
+	res->voiceNum = 0;
+	res->maxVoiceNum = 0;
+	res->channels = TSF_NULL;
+	res->effects = TSF_NULL;
+	res->outputSamples = TSF_NULL;
+	res->outputSampleSize = 0;
+	res->voicePlayIndex = 0;
+	if (f->effects)
+	{
+		// only the parameters, the delay lines are set up with the first block rendered
+		struct tsf_effects *from = f->effects, *to = tsf_effects_init(res);
+		if (!to) { TSF_FREE(res); return TSF_NULL; }
+		to->reverbOn = from->reverbOn, to->chorusOn = from->chorusOn;
+		to->roomSize = from->roomSize, to->damping = from->damping, to->width = from->width, to->reverbLevel = from->reverbLevel;
+		to->chorusDepth = from->chorusDepth, to->chorusRate = from->chorusRate, to->chorusLevel = from->chorusLevel;
+	}
+	(*res->refCount)++;
+	return res;
+}
+
 TSFDEF void tsf_reset(tsf* f)
 {
 	struct tsf_voice *v = f->voices, *vEnd = v + f->voiceNum;
 	for (; v != vEnd; v++)
+	{
 		if (v->playingPreset != -1 && (v->ampenv.segment < TSF_SEGMENT_RELEASE || v->ampenv.parameters.release))
 			tsf_voice_endquick(f, v);
+		v->reverbSend = v->chorusSend = 0; //keep the effects silent
+		v->playingChannel = -1; //and the fading voices out of reach of the new channels
+	}
 	if (f->channels) { TSF_FREE(f->channels->channels); TSF_FREE(f->channels); f->channels = TSF_NULL; }
+	if (f->effects) tsf_effects_clear(f->effects);
 }
 
 TSFDEF int tsf_get_presetindex(const tsf* f, int bank, int preset_number)
@@ -1344,6 +1937,34 @@ TSFDEF void tsf_set_max_voices(tsf* f, int max_voices)
 		f->voices[i].playingPreset = -1;
 }
 
+TSFDEF void tsf_set_effects(tsf* f, int flag_reverb, int flag_chorus)
+{
+	struct tsf_effects* e = tsf_effects_init(f);
+	if (!e) return;
+	e->reverbOn = (TSF_BOOL)(flag_reverb != 0);
+	e->chorusOn = (TSF_BOOL)(flag_chorus != 0);
+	if (e->sampleRate) tsf_effects_clear(e);
+}
+
+TSFDEF void tsf_set_reverb(tsf* f, float room_size, float damping, float width, float level)
+{
+	struct tsf_effects* e = tsf_effects_init(f);
+	if (!e) return;
+	e->roomSize = (room_size < 0 ? 0 : (room_size > 1 ? 1 : room_size));
+	e->damping = (damping < 0 ? 0 : (damping > 1 ? 1 : damping));
+	e->width = (width < 0 ? 0 : (width > 1 ? 1 : width));
+	e->reverbLevel = (level < 0 ? 0 : level);
+}
+
+TSFDEF void tsf_set_chorus(tsf* f, float depth_ms, float rate_hz, float level)
+{
+	struct tsf_effects* e = tsf_effects_init(f);
+	if (!e) return;
+	e->chorusDepth = (depth_ms < 0 ? 0 : (depth_ms > TSF_CHORUS_MAXDEPTH ? TSF_CHORUS_MAXDEPTH : depth_ms));
+	e->chorusRate = (rate_hz < 0 ? 0 : rate_hz);
+	e->chorusLevel = (level < 0 ? 0 : level);
+}
+
 TSFDEF void tsf_note_on(tsf* f, int preset_index, int key, float vel)
 {
 	short midiVelocity = (short)(vel * 127);
@@ -1357,7 +1978,7 @@ TSFDEF void tsf_note_on(tsf* f, int preset_index, int key, float vel)
 	voicePlayIndex = f->voicePlayIndex++;
 	for (region = f->presets[preset_index].regions, regionEnd = region + f->presets[preset_index].regionNum; region != regionEnd; region++)
 	{
-		struct tsf_voice *voice, *v, *vEnd; TSF_BOOL doLoop; float lowpassFilterQDB, lowpassFc;
+		struct tsf_voice *voice, *v, *vEnd; TSF_BOOL doLoop;
 		if (key < region->lokey || key > region->hikey || midiVelocity < region->lovel || midiVelocity > region->hivel) continue;
 
 		voice = TSF_NULL, v = f->voices, vEnd = v + f->voiceNum;
@@ -1386,7 +2007,17 @@ TSFDEF void tsf_note_on(tsf* f, int preset_index, int key, float vel)
 		voice->playingPreset = preset_index;
 		voice->playingKey = key;
 		voice->playIndex = voicePlayIndex;
-		voice->noteGainDB = f->globalGainDB - region->attenuation - tsf_gainToDecibels(1.0f / vel);
+		voice->midiVelocity = midiVelocity;
+		voice->noteGainDB = f->globalGainDB - region->attenuation; //the velocity is applied by the default modulators
+		voice->filterFc = (float)region->initialFilterFc;
+		voice->reverbSend = region->reverbSend / 1000.0f;
+		voice->chorusSend = region->chorusSend / 1000.0f;
+		voice->noteOffPending = voice->sostenuto = 0;
+
+		// Apply the modulators.
+		TSF_MEMSET(&voice->modulation, 0, sizeof(voice->modulation));
+		TSF_MEMSET(&voice->perNote, 0, sizeof(voice->perNote));
+		tsf_voice_modulate(voice, (f->channels ? &f->channels->channels[f->channels->activeChannel] : TSF_NULL));
 
 		if (f->channels)
 		{
@@ -1395,9 +2026,7 @@ TSFDEF void tsf_note_on(tsf* f, int preset_index, int key, float vel)
 		else
 		{
 			tsf_voice_calcpitchratio(voice, 0, f->outSampleRate);
-			// The SFZ spec is silent about the pan curve, but a 3dB pan law seems common. This sqrt() curve matches what Dimension LE does; Alchemy Free seems closer to sin(adjustedPan * pi/2).
-			voice->panFactorLeft  = TSF_SQRTF(0.5f - region->pan);
-			voice->panFactorRight = TSF_SQRTF(0.5f + region->pan);
+			tsf_voice_calcpan(voice, 0.0f);
 		}
 
 		// Offset/end.
@@ -1413,12 +2042,8 @@ TSFDEF void tsf_note_on(tsf* f, int preset_index, int key, float vel)
 		tsf_voice_envelope_setup(&voice->modenv, &region->modenv, key, midiVelocity, TSF_FALSE, f->outSampleRate);
 
 		// Setup lowpass filter.
-		lowpassFc = (region->initialFilterFc <= 13500 ? tsf_cents2Hertz((float)region->initialFilterFc) / f->outSampleRate : 1.0f);
-		lowpassFilterQDB = region->initialFilterQ / 10.0f;
-		voice->lowpass.QInv = 1.0 / TSF_POW(10.0, (lowpassFilterQDB / 20.0));
 		voice->lowpass.z1 = voice->lowpass.z2 = 0;
-		voice->lowpass.active = (lowpassFc < 0.499f);
-		if (voice->lowpass.active) tsf_voice_lowpass_setup(&voice->lowpass, lowpassFc);
+		tsf_voice_lowpass_update(voice, f->outSampleRate);
 
 		// Setup LFO filters.
 		tsf_voice_lfo_setup(&voice->modlfo, region->delayModLFO, region->freqModLFO, f->outSampleRate);
@@ -1510,22 +2135,33 @@ TSFDEF void tsf_render_short(tsf* f, short* buffer, int samples, int flag_mixing
 TSFDEF void tsf_render_float(tsf* f, float* buffer, int samples, int flag_mixing)
 {
 	struct tsf_voice *v = f->voices, *vEnd = v + f->voiceNum;
+	struct tsf_effects* e = tsf_effects_prepare(f, samples);
 	if (!flag_mixing) TSF_MEMSET(buffer, 0, (f->outputmode == TSF_MONO ? 1 : 2) * sizeof(float) * samples);
 	for (; v != vEnd; v++)
 		if (v->playingPreset != -1)
 			tsf_voice_render(f, v, buffer, samples);
+	if (e) tsf_effects_render(f, e, buffer, samples);
+}
+
+static float tsf_channel_pitchshift(struct tsf_channel* c)
+{
+	return (c->pitchWheel == 8192 ? c->tuning : ((c->pitchWheel / 16383.0f * c->pitchRange * 2.0f) - c->pitchRange + c->tuning));
 }
 
 static void tsf_channel_setup_voice(tsf* f, struct tsf_voice* v)
 {
 	struct tsf_channel* c = &f->channels->channels[f->channels->activeChannel];
-	float newpan = v->region->pan + c->panOffset;
 	v->playingChannel = f->channels->activeChannel;
-	v->noteGainDB += c->gainDB;
-	tsf_voice_calcpitchratio(v, (c->pitchWheel == 8192 ? c->tuning : ((c->pitchWheel / 16383.0f * c->pitchRange * 2.0f) - c->pitchRange + c->tuning)), f->outSampleRate);
-	if      (newpan <= -0.5f) { v->panFactorLeft = 1.0f; v->panFactorRight = 0.0f; }
-	else if (newpan >=  0.5f) { v->panFactorLeft = 0.0f; v->panFactorRight = 1.0f; }
-	else { v->panFactorLeft = TSF_SQRTF(0.5f - newpan); v->panFactorRight = TSF_SQRTF(0.5f + newpan); }
+	v->noteGainDB += c->gainDB + c->mixGainDB + f->channels->masterGainDB;
+	if (c->soft) { v->noteGainDB -= TSF_SOFTPEDAL_ATTENUATION; v->filterFc -= TSF_SOFTPEDAL_FILTERFC; }
+	if (v->playingKey >= 0 && v->playingKey < 128)
+	{
+		v->perNote = c->perNote[v->playingKey];
+		v->noteGainDB += v->perNote.gainDB;
+		v->filterFc += v->perNote.filterFc;
+	}
+	tsf_voice_calcpitchratio(v, tsf_channel_pitchshift(c), f->outSampleRate);
+	tsf_voice_calcpan(v, c->panOffset);
 }
 
 static struct tsf_channel* tsf_channel_init(tsf* f, int channel)
@@ -1539,6 +2175,7 @@ static struct tsf_channel* tsf_channel_init(tsf* f, int channel)
 		f->channels->channels = NULL;
 		f->channels->channelNum = 0;
 		f->channels->activeChannel = 0;
+		f->channels->masterGainDB = 0.0f;
 	}
 	i = f->channels->channelNum;
 	f->channels->channelNum = channel + 1;
@@ -1546,15 +2183,28 @@ static struct tsf_channel* tsf_channel_init(tsf* f, int channel)
 	for (; i <= channel; i++)
 	{
 		struct tsf_channel* c = &f->channels->channels[i];
-		c->presetIndex = c->bank = 0;
+		int preset_index = tsf_get_presetindex(f, (i == 9 ? 128 : 0), 0); //General MIDI default program
+		c->presetIndex = (unsigned short)(preset_index == -1 ? 0 : preset_index);
+		c->bank = 0;
+		c->drums = (i == 9);
+		c->sustain = c->sostenuto = c->soft = 0;
+		TSF_MEMSET(c->midiControls, 0, sizeof(c->midiControls));
+		TSF_MEMSET(c->midiKeyPressure, 0, sizeof(c->midiKeyPressure));
+		TSF_MEMSET(c->perNote, 0, sizeof(c->perNote));
+		c->midiControls[7] = c->midiControls[11] = 127; //volume and expression
+		c->midiControls[10] = 64; //pan
+		c->midiControls[91] = 40; //reverb send, General MIDI 2 default
+		c->midiPressure = 0;
 		c->pitchWheel = c->midiPan = 8192;
 		c->midiVolume = c->midiExpression = 16383;
 		c->midiRPN = 0xFFFF;
 		c->midiData = 0;
 		c->panOffset = 0.0f;
 		c->gainDB = 0.0f;
+		c->mixGainDB = 0.0f;
 		c->pitchRange = 2.0f;
 		c->tuning = 0.0f;
+		c->pressureVibrato = c->pressureFilterFc = c->pressureAttenuation = 0.0f;
 	}
 	return &f->channels->channels[channel];
 }
@@ -1562,12 +2212,45 @@ static struct tsf_channel* tsf_channel_init(tsf* f, int channel)
 static void tsf_channel_applypitch(tsf* f, int channel, struct tsf_channel* c)
 {
 	struct tsf_voice *v, *vEnd;
-	float pitchShift = (c->pitchWheel == 8192 ? c->tuning : ((c->pitchWheel / 16383.0f * c->pitchRange * 2.0f) - c->pitchRange + c->tuning));
+	float pitchShift = tsf_channel_pitchshift(c);
 	for (v = f->voices, vEnd = v + f->voiceNum; v != vEnd; v++)
 		if (v->playingChannel == channel && v->playingPreset != -1)
 			tsf_voice_calcpitchratio(v, pitchShift, f->outSampleRate);
 }
 
+//Evaluate the modulators of the voices playing on a channel (or only a key of it if not -1) again after one of its sources changed
+static void tsf_channel_modulate(tsf* f, int channel, struct tsf_channel* c, int key)
+{
+	struct tsf_voice *v, *vEnd;
+	float pitchShift = tsf_channel_pitchshift(c);
+	for (v = f->voices, vEnd = v + f->voiceNum; v != vEnd; v++)
+		if (v->playingChannel == channel && v->playingPreset != -1 && (key == -1 || v->playingKey == key) && tsf_voice_modulate(v, c))
+		{
+			tsf_voice_calcpitchratio(v, pitchShift, f->outSampleRate);
+			tsf_voice_calcpan(v, c->panOffset);
+			tsf_voice_lowpass_update(v, f->outSampleRate);
+		}
+}
+
+// Apply the per-note controls of a key (or all keys if key is -1) to the voices playing it
+static void tsf_channel_pernote_update(tsf* f, int channel, struct tsf_channel* c, int key)
+{
+	struct tsf_voice *v, *vEnd;
+	float pitchShift = tsf_channel_pitchshift(c);
+	for (v = f->voices, vEnd = v + f->voiceNum; v != vEnd; v++)
+	{
+		struct tsf_voice_pernote* n;
+		if (v->playingChannel != channel || v->playingPreset == -1 || (key != -1 && v->playingKey != key) || v->playingKey < 0 || v->playingKey > 127) continue;
+		n = &c->perNote[v->playingKey];
+		v->noteGainDB += n->gainDB - v->perNote.gainDB;
+		v->filterFc += n->filterFc - v->perNote.filterFc;
+		v->perNote = *n;
+		tsf_voice_calcpitchratio(v, pitchShift, f->outSampleRate);
+		tsf_voice_calcpan(v, c->panOffset);
+		tsf_voice_lowpass_update(v, f->outSampleRate);
+	}
+}
+
 TSFDEF void tsf_channel_set_presetindex(tsf* f, int channel, int preset_index)
 {
 	tsf_channel_init(f, channel)->presetIndex = (unsigned short)preset_index;
@@ -1614,12 +2297,7 @@ TSFDEF void tsf_channel_set_pan(tsf* f, int channel, float pan)
 	struct tsf_voice *v, *vEnd;
 	for (v = f->voices, vEnd = v + f->voiceNum; v != vEnd; v++)
 		if (v->playingChannel == channel && v->playingPreset != -1)
-		{
-			float newpan = v->region->pan + pan - 0.5f;
-			if      (newpan <= -0.5f) { v->panFactorLeft = 1.0f; v->panFactorRight = 0.0f; }
-			else if (newpan >=  0.5f) { v->panFactorLeft = 0.0f; v->panFactorRight = 1.0f; }
-			else { v->panFactorLeft = TSF_SQRTF(0.5f - newpan); v->panFactorRight = TSF_SQRTF(0.5f + newpan); }
-		}
+			tsf_voice_calcpan(v, pan - 0.5f);
 	tsf_channel_init(f, channel)->panOffset = pan - 0.5f;
 }
 
@@ -1641,6 +2319,7 @@ TSFDEF void tsf_channel_set_pitchwheel(tsf* f, int channel, int pitch_wheel)
 	if (c->pitchWheel == pitch_wheel) return;
 	c->pitchWheel = (unsigned short)pitch_wheel;
 	tsf_channel_applypitch(f, channel, c);
+	tsf_channel_modulate(f, channel, c, -1);
 }
 
 TSFDEF void tsf_channel_set_pitchrange(tsf* f, int channel, float pitch_range)
@@ -1649,6 +2328,7 @@ TSFDEF void tsf_channel_set_pitchrange(tsf* f, int channel, float pitch_range)
 	if (c->pitchRange == pitch_range) return;
 	c->pitchRange = pitch_range;
 	if (c->pitchWheel != 8192) tsf_channel_applypitch(f, channel, c);
+	tsf_channel_modulate(f, channel, c, -1);
 }
 
 TSFDEF void tsf_channel_set_tuning(tsf* f, int channel, float tuning)
@@ -1669,10 +2349,13 @@ TSFDEF void tsf_channel_note_on(tsf* f, int channel, int key, float vel)
 TSFDEF void tsf_channel_note_off(tsf* f, int channel, int key)
 {
 	struct tsf_voice *v = f->voices, *vEnd = v + f->voiceNum, *vMatchFirst = TSF_NULL, *vMatchLast = TSF_NULL;
+	if (!f->channels || channel >= f->channels->channelNum) return;
+	//the next note of the key starts without the per-note controls, the released voices keep them
+	if (key >= 0 && key < 128) TSF_MEMSET(&f->channels->channels[channel].perNote[key], 0, sizeof(struct tsf_voice_pernote));
 	for (; v != vEnd; v++)
 	{
 		//Find the first and last entry in the voices list with matching channel, key and look up the smallest play index
-		if (v->playingPreset == -1 || v->playingChannel != channel || v->playingKey != key || v->ampenv.segment >= TSF_SEGMENT_RELEASE) continue;
+		if (v->playingPreset == -1 || v->playingChannel != channel || v->playingKey != key || v->ampenv.segment >= TSF_SEGMENT_RELEASE || v->noteOffPending) continue;
 		else if (!vMatchFirst || v->playIndex < vMatchFirst->playIndex) vMatchFirst = vMatchLast = v;
 		else if (v->playIndex == vMatchFirst->playIndex) vMatchLast = v;
 	}
@@ -1681,17 +2364,56 @@ TSFDEF void tsf_channel_note_off(tsf* f, int channel, int key)
 	{
 		//Stop all voices with matching channel, key and the smallest play index which was enumerated above
 		if (v != vMatchFirst && v != vMatchLast &&
-			(v->playIndex != vMatchFirst->playIndex || v->playingPreset == -1 || v->playingChannel != channel || v->playingKey != key || v->ampenv.segment >= TSF_SEGMENT_RELEASE)) continue;
-		tsf_voice_end(f, v);
+			(v->playIndex != vMatchFirst->playIndex || v->playingPreset == -1 || v->playingChannel != channel || v->playingKey != key || v->ampenv.segment >= TSF_SEGMENT_RELEASE || v->noteOffPending)) continue;
+		if (f->channels->channels[channel].sustain || v->sostenuto) v->noteOffPending = 1;
+		else tsf_voice_end(f, v);
+	}
+}
+
+//End the voices of a channel with a note off held back by pedals which are no longer held
+static void tsf_channel_release_pending(tsf* f, int channel)
+{
+	struct tsf_channel *c = &f->channels->channels[channel];
+	struct tsf_voice *v = f->voices, *vEnd = v + f->voiceNum;
+	for (; v != vEnd; v++)
+	{
+		if (v->playingPreset == -1 || v->playingChannel != channel || !v->noteOffPending || c->sustain || v->sostenuto) continue;
+		v->noteOffPending = 0;
+		if (v->ampenv.segment < TSF_SEGMENT_RELEASE) tsf_voice_end(f, v);
 	}
 }
 
+static void tsf_channel_set_sustain(tsf* f, int channel, int flag_sustain)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	c->sustain = flag_sustain;
+	if (!flag_sustain) tsf_channel_release_pending(f, channel);
+}
+
+static void tsf_channel_set_sostenuto(tsf* f, int channel, int flag_sostenuto)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	struct tsf_voice *v = f->voices, *vEnd = v + f->voiceNum;
+	if (c->sostenuto == flag_sostenuto) return;
+	c->sostenuto = flag_sostenuto;
+	//pressing the pedal captures the notes being held down right now, releasing it lets them go
+	for (; v != vEnd; v++)
+		if (v->playingPreset != -1 && v->playingChannel == channel)
+			v->sostenuto = (unsigned char)(flag_sostenuto && !v->noteOffPending && v->ampenv.segment < TSF_SEGMENT_RELEASE);
+	if (!flag_sostenuto) tsf_channel_release_pending(f, channel);
+}
+
 TSFDEF void tsf_channel_note_off_all(tsf* f, int channel)
 {
 	struct tsf_voice *v = f->voices, *vEnd = v + f->voiceNum;
+	if (f->channels && channel < f->channels->channelNum)
+		TSF_MEMSET(f->channels->channels[channel].perNote, 0, sizeof(f->channels->channels[channel].perNote));
 	for (; v != vEnd; v++)
 		if (v->playingPreset != -1 && v->playingChannel == channel && v->ampenv.segment < TSF_SEGMENT_RELEASE)
+		{
+			v->noteOffPending = v->sostenuto = 0;
 			tsf_voice_end(f, v);
+		}
 }
 
 TSFDEF void tsf_channel_sounds_off_all(tsf* f, int channel)
@@ -1705,6 +2427,11 @@ TSFDEF void tsf_channel_sounds_off_all(tsf* f, int channel)
 TSFDEF void tsf_channel_midi_control(tsf* f, int channel, int controller, int control_value)
 {
 	struct tsf_channel* c = tsf_channel_init(f, channel);
+	if (controller >= 0 && controller < 120 && c->midiControls[controller] != control_value)
+	{
+		c->midiControls[controller] = (unsigned char)control_value;
+		tsf_channel_modulate(f, channel, c, -1);
+	}
 	switch (controller)
 	{
 		case   7 /*VOLUME_MSB*/      : c->midiVolume     = (unsigned short)((c->midiVolume     & 0x7F  ) | (control_value << 7)); goto TCMC_SET_VOLUME;
@@ -1721,15 +2448,30 @@ TSFDEF void tsf_channel_midi_control(tsf* f, int channel, int controller, int co
 		case 100 /*RPN_LSB*/         : c->midiRPN = (unsigned short)(((c->midiRPN == 0xFFFF ? 0 : c->midiRPN) & 0x3F80) |  control_value); return;
 		case  98 /*NRPN_LSB*/        : c->midiRPN = 0xFFFF; return;
 		case  99 /*NRPN_MSB*/        : c->midiRPN = 0xFFFF; return;
+		case  64 /*SUSTAIN*/         : tsf_channel_set_sustain(f, channel, control_value >= 64); return;
+		case  66 /*SOSTENUTO*/       : tsf_channel_set_sostenuto(f, channel, control_value >= 64); return;
+		case  67 /*SOFT_PEDAL*/      : c->soft = (control_value >= 64); return;
 		case 120 /*ALL_SOUND_OFF*/   : tsf_channel_sounds_off_all(f, channel); return;
 		case 123 /*ALL_NOTES_OFF*/   : tsf_channel_note_off_all(f, channel);   return;
 		case 121 /*ALL_CTRL_OFF*/    :
+			tsf_channel_set_sustain(f, channel, 0);
+			tsf_channel_set_sostenuto(f, channel, 0);
+			c->soft = 0;
 			c->midiVolume = c->midiExpression = 16383;
 			c->midiPan = 8192;
 			c->bank = 0;
+			c->midiControls[1] = c->midiControls[2] = c->midiControls[4] = 0; //modulation, breath and foot controller
+			c->midiControls[7] = c->midiControls[11] = 127;
+			c->midiControls[10] = 64;
+			c->midiControls[64] = c->midiControls[66] = c->midiControls[67] = 0;
+			c->midiPressure = 0;
+			TSF_MEMSET(c->midiKeyPressure, 0, sizeof(c->midiKeyPressure));
+			TSF_MEMSET(c->perNote, 0, sizeof(c->perNote));
+			tsf_channel_pernote_update(f, channel, c, -1);
 			tsf_channel_set_volume(f, channel, 1.0f);
 			tsf_channel_set_pan(f, channel, 0.5f);
 			tsf_channel_set_pitchrange(f, channel, 2.0f);
+			tsf_channel_modulate(f, channel, c, -1);
 			return;
 	}
 	return;
@@ -1747,6 +2489,149 @@ TCMC_SET_DATA:
 	return;
 }
 
+TSFDEF void tsf_channel_midi_pressure(tsf* f, int channel, int pressure)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	if (c->midiPressure == pressure) return;
+	c->midiPressure = (unsigned char)pressure;
+	tsf_channel_modulate(f, channel, c, -1);
+}
+
+TSFDEF void tsf_channel_midi_key_pressure(tsf* f, int channel, int key, int pressure)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	if (key < 0 || key > 127 || c->midiKeyPressure[key] == pressure) return;
+	c->midiKeyPressure[key] = (unsigned char)pressure;
+	tsf_channel_modulate(f, channel, c, key);
+}
+
+TSFDEF void tsf_channel_set_pressure_response(tsf* f, int channel, float vibrato_cents, float filter_cents, float volume_db)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	c->pressureVibrato = (vibrato_cents < 0 ? 0 : (vibrato_cents > 100 ? 100 : vibrato_cents));
+	c->pressureFilterFc = (filter_cents < 0 ? 0 : (filter_cents > 4800 ? 4800 : filter_cents));
+	c->pressureAttenuation = (volume_db < 0 ? 0 : (volume_db > 96 ? 96 : volume_db)) * 10.0f;
+	tsf_channel_modulate(f, channel, c, -1);
+}
+
+TSFDEF void tsf_channel_set_note_pitchbend(tsf* f, int channel, int key, float semitones)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	if (key < 0 || key > 127) return;
+	c->perNote[key].pitch = semitones;
+	tsf_channel_pernote_update(f, channel, c, key);
+}
+
+TSFDEF void tsf_channel_set_note_volume(tsf* f, int channel, int key, float volume)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	if (key < 0 || key > 127) return;
+	c->perNote[key].gainDB = tsf_gainToDecibels(volume);
+	tsf_channel_pernote_update(f, channel, c, key);
+}
+
+TSFDEF void tsf_channel_set_note_pan(tsf* f, int channel, int key, float pan)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	if (key < 0 || key > 127) return;
+	c->perNote[key].pan = pan - 0.5f;
+	tsf_channel_pernote_update(f, channel, c, key);
+}
+
+TSFDEF void tsf_channel_set_note_filter(tsf* f, int channel, int key, float cents)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	if (key < 0 || key > 127) return;
+	c->perNote[key].filterFc = cents;
+	tsf_channel_pernote_update(f, channel, c, key);
+}
+
+TSFDEF int tsf_channel_midi_program(tsf* f, int channel, int program)
+{
+	return tsf_channel_set_presetnumber(f, channel, program, tsf_channel_init(f, channel)->drums);
+}
+
+TSFDEF void tsf_channel_set_drums(tsf* f, int channel, int flag_drums)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	int preset_index;
+	if (c->drums == (flag_drums != 0)) return;
+	c->drums = (flag_drums != 0);
+	//switch between the default kit and the default program right away, like GS does for "use for rhythm part"
+	preset_index = tsf_get_presetindex(f, (c->drums ? 128 : 0), 0);
+	if (preset_index != -1) c->presetIndex = (unsigned short)preset_index;
+}
+
+TSFDEF void tsf_channel_set_mixvolume(tsf* f, int channel, float volume)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	float gainDB = tsf_gainToDecibels(volume), gainDBChange = gainDB - c->mixGainDB;
+	struct tsf_voice *v, *vEnd;
+	if (gainDBChange == 0) return;
+	for (v = f->voices, vEnd = v + f->voiceNum; v != vEnd; v++)
+		if (v->playingChannel == channel && v->playingPreset != -1)
+			v->noteGainDB += gainDBChange;
+	c->mixGainDB = gainDB;
+}
+
+TSFDEF void tsf_channel_reset(tsf* f, int channel)
+{
+	struct tsf_channel *c = tsf_channel_init(f, channel);
+	tsf_channel_midi_control(f, channel, 121 /*ALL_CTRL_OFF*/, 0);
+	tsf_channel_set_pitchwheel(f, channel, 8192);
+	tsf_channel_set_tuning(f, channel, 0.0f);
+	tsf_channel_midi_control(f, channel, 91 /*REVERB_SEND*/, 40);
+	tsf_channel_midi_control(f, channel, 93 /*CHORUS_SEND*/, 0);
+	c->midiRPN = 0xFFFF;
+	c->midiData = 0;
+	c->drums = (channel == 9);
+	tsf_channel_midi_program(f, channel, 0);
+}
+
+static void tsf_set_master_volume(tsf* f, int volume)
+{
+	//same curve as the channel volume controller
+	float gainDB = tsf_gainToDecibels(TSF_POWF(volume / 16383.0f, 3.0f)), gainDBChange;
+	struct tsf_voice *v, *vEnd;
+	tsf_channel_init(f, 0);
+	gainDBChange = gainDB - f->channels->masterGainDB;
+	for (v = f->voices, vEnd = v + f->voiceNum; v != vEnd; v++)
+		if (v->playingPreset != -1)
+			v->noteGainDB += gainDBChange;
+	f->channels->masterGainDB = gainDB;
+}
+
+TSFDEF int tsf_midi_sysex(tsf* f, const void* data, int length)
+{
+	const unsigned char* d = (const unsigned char*)data;
+	int i;
+	if (length > 0 && d[0] == 0xF0) { d++; length--; }
+	if (length >= 4 && d[0] == 0x7E && d[2] == 0x09 && (d[3] == 0x01 || d[3] == 0x03))
+		goto TMS_RESET; //GM System On (or GM2 System On)
+	if (length >= 8 && d[0] == 0x41 && d[2] == 0x42 && d[3] == 0x12 && d[4] == 0x40 && d[5] == 0x00 && d[6] == 0x7F && d[7] == 0x00)
+		goto TMS_RESET; //GS Reset
+	if (length >= 7 && d[0] == 0x43 && (d[1] & 0xF0) == 0x10 && d[2] == 0x4C && d[3] == 0x00 && d[4] == 0x00 && d[5] == 0x7E && d[6] == 0x00)
+		goto TMS_RESET; //XG System On
+	if (length >= 6 && d[0] == 0x7F && d[2] == 0x04 && d[3] == 0x01)
+	{
+		//Master Volume
+		tsf_set_master_volume(f, (d[5] << 7) | d[4]);
+		return 1;
+	}
+	if (length >= 8 && d[0] == 0x41 && d[2] == 0x42 && d[3] == 0x12 && d[4] == 0x40 && (d[5] & 0xF0) == 0x10 && d[6] == 0x15)
+	{
+		//GS Use For Rhythm Part, parts are numbered 10, 1 to 9, 11 to 16
+		int part = d[5] & 0x0F, channel = (part == 0 ? 9 : (part <= 9 ? part - 1 : part));
+		tsf_channel_set_drums(f, channel, d[7] != 0);
+		return 1;
+	}
+	return 0;
+TMS_RESET:
+	for (i = 0; i < 16; i++) { tsf_channel_sounds_off_all(f, i); tsf_channel_reset(f, i); }
+	tsf_set_master_volume(f, 16383);
+	return 1;
+}
+
 TSFDEF int tsf_channel_get_preset_index(tsf* f, int channel)
 {
 	return (f->channels && channel < f->channels->channelNum ? f->channels->channels[channel].presetIndex : 0);
@@ -1787,6 +2672,26 @@ TSFDEF float tsf_channel_get_tuning(tsf* f, int channel)
 	return (f->channels && channel < f->channels->channelNum ? f->channels->channels[channel].tuning : 0.0f);
 }
 
+TSFDEF int tsf_channel_get_drums(tsf* f, int channel)
+{
+	return (f->channels && channel < f->channels->channelNum ? f->channels->channels[channel].drums : (channel == 9));
+}
+
+TSFDEF float tsf_channel_get_mixvolume(tsf* f, int channel)
+{
+	return (f->channels && channel < f->channels->channelNum ? tsf_decibelsToGain(f->channels->channels[channel].mixGainDB) : 1.0f);
+}
+
+TSFDEF int tsf_channel_get_pressure(tsf* f, int channel)
+{
+	return (f->channels && channel < f->channels->channelNum ? f->channels->channels[channel].midiPressure : 0);
+}
+
+TSFDEF int tsf_channel_get_key_pressure(tsf* f, int channel, int key)
+{
+	return (f->channels && channel < f->channels->channelNum && key >= 0 && key <= 127 ? f->channels->channels[channel].midiKeyPressure[key] : 0);
+}
+
 #ifdef __cplusplus
 }
 #endif